@@ -0,0 +1,196 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+//反序列化Calendar
+func UnpackCalendar(value []byte) (ret *Calendar, err error) {
+	var (
+		calendar *Calendar
+	)
+
+	calendar = &Calendar{}
+	if err = json.Unmarshal(value, calendar); err != nil {
+		return
+	}
+	ret = calendar
+	return
+}
+
+//从/cron/calendars/holidays提取holidays
+func ExtractCalendarName(calendarKey string) string {
+	return strings.TrimPrefix(calendarKey, JOB_CALENDAR_DIR)
+}
+
+//日历变化事件
+func BuildCalendarEvent(eventType int, calendar *Calendar) (jobEvent *JobEvent) {
+	return &JobEvent{
+		EventType: eventType,
+		Calendar:  calendar,
+	}
+}
+
+//校验日历的日期格式
+func VerifyCalendar(calendar *Calendar) (err error) {
+	var (
+		date string
+	)
+
+	for _, date = range calendar.Dates {
+		if _, err = time.Parse("2006-01-02", date); err != nil {
+			err = ERR_CALENDAR_DATE
+			return
+		}
+	}
+	return
+}
+
+//日历是否包含某一天
+func calendarHasDate(calendar *Calendar, date string) bool {
+	var (
+		calendarDate string
+	)
+
+	if calendar == nil {
+		return false
+	}
+	for _, calendarDate = range calendar.Dates {
+		if calendarDate == date {
+			return true
+		}
+	}
+	return false
+}
+
+//判断某个调度时间是否被任务的日历允许, 不允许时返回原因
+func CheckCalendars(job *Job, planTime time.Time, calendars map[string]*Calendar) (ok bool, reason string) {
+	var (
+		date string
+		name string
+	)
+
+	date = planTime.Format("2006-01-02")
+
+	//在任意一个排除日历中, 跳过
+	for _, name = range job.ExcludeCalendars {
+		if calendarHasDate(calendars[name], date) {
+			return false, "排除日历: " + name
+		}
+	}
+
+	//配置了包含日历时, 必须在其中一个中
+	if len(job.IncludeCalendars) == 0 {
+		return true, ""
+	}
+	for _, name = range job.IncludeCalendars {
+		if calendarHasDate(calendars[name], date) {
+			return true, ""
+		}
+	}
+	return false, "不在包含日历中: " + strings.Join(job.IncludeCalendars, ",")
+}
+
+//解析iCalendar(RFC 5545)文件, 提取所有VEVENT覆盖的日期
+//全天事件DTEND是开区间, 按天展开; 带时间的事件取DTSTART所在日期
+func ParseICalendarDates(content string) (dates []string, err error) {
+	var (
+		scanner  *bufio.Scanner
+		lines    []string
+		line     string
+		inEvent  bool
+		dtStart  time.Time
+		dtEnd    time.Time
+		allDay   bool
+		name     string
+		value    string
+		idx      int
+		parsed   time.Time
+		isDate   bool
+		parseErr error
+	)
+
+	//展开折叠行: 以空格或tab开头的行是上一行的续行
+	scanner = bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line = strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) != 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line = range lines {
+		if idx = strings.Index(line, ":"); idx < 0 {
+			continue
+		}
+		name, value = strings.ToUpper(line[:idx]), strings.TrimSpace(line[idx+1:])
+
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VEVENT":
+			inEvent, dtStart, dtEnd, allDay = true, time.Time{}, time.Time{}, false
+		case name == "END" && strings.ToUpper(value) == "VEVENT":
+			if !inEvent || dtStart.IsZero() {
+				err = ERR_ICALENDAR_FORMAT
+				return
+			}
+			inEvent = false
+			dates = append(dates, dtStart.Format("2006-01-02"))
+			if allDay && !dtEnd.IsZero() {
+				for parsed = dtStart.AddDate(0, 0, 1); parsed.Before(dtEnd); parsed = parsed.AddDate(0, 0, 1) {
+					dates = append(dates, parsed.Format("2006-01-02"))
+				}
+			}
+		case inEvent && (strings.HasPrefix(name, "DTSTART") || strings.HasPrefix(name, "DTEND")):
+			if parsed, isDate, parseErr = parseICalendarTime(line[:idx], value); parseErr != nil {
+				err = ERR_ICALENDAR_FORMAT
+				return
+			}
+			if strings.HasPrefix(name, "DTSTART") {
+				dtStart, allDay = parsed, isDate
+			} else {
+				dtEnd = parsed
+			}
+		}
+	}
+
+	dates = StrSliceRemoveRepeat(dates)
+	return
+}
+
+//解析iCalendar的DATE或DATE-TIME值, property是带参数的属性名, 如DTSTART;TZID=Asia/Shanghai
+//带TZID的时间按该时区解析再换算成本地时间, 和UTC时间的处理一致
+func parseICalendarTime(property string, value string) (parsed time.Time, isDate bool, err error) {
+	var (
+		loc   *time.Location
+		param string
+	)
+
+	loc = time.Local
+	for _, param = range strings.Split(property, ";")[1:] {
+		if strings.HasPrefix(strings.ToUpper(param), "TZID=") {
+			if loc, err = time.LoadLocation(strings.Trim(param[len("TZID="):], "\"")); err != nil {
+				return
+			}
+		}
+	}
+
+	switch {
+	case len(value) == 8: //20261225
+		parsed, err = time.ParseInLocation("20060102", value, time.Local)
+		isDate = true
+	case strings.HasSuffix(value, "Z"): //20261225T090000Z
+		if parsed, err = time.Parse("20060102T150405Z", value); err == nil {
+			parsed = parsed.In(time.Local)
+		}
+	default: //20261225T090000
+		if parsed, err = time.ParseInLocation("20060102T150405", value, loc); err == nil {
+			parsed = parsed.In(time.Local)
+		}
+	}
+	return
+}
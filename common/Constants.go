@@ -1,14 +1,20 @@
 package common
 
 const (
-	//任务保存目录
-	JOB_SAVE_DIR = "/cron/jobs"
+	//任务保存目录: /cron/jobs/命名空间/任务名
+	JOB_SAVE_DIR = "/cron/jobs/"
+
+	//引入命名空间之前的任务保存前缀: /cron/jobs任务名, master启动时迁移到default命名空间
+	JOB_LEGACY_SAVE_DIR = "/cron/jobs"
 
 	//任务强杀目录
-	JOB_KILLER_DIR = "cron/killer"
+	JOB_KILLER_DIR = "/cron/killer/"
 
 	//任务立即执行目录
-	JOB_ONCE_DIR = "cron/once"
+	JOB_ONCE_DIR = "/cron/once/"
+
+	//默认命名空间
+	JOB_DEFAULT_NAMESPACE = "default"
 
 	//任务锁目录
 	JOB_LOCK_DIR = "/cron/lock/"
@@ -16,6 +22,67 @@ const (
 	//服务注册目录
 	JOB_WORKER_DIR = "/cron/workers/"
 
+	//任务修改历史目录: /cron/history/命名空间/任务名/版本号
+	JOB_HISTORY_DIR = "/cron/history/"
+
+	//每个任务保留的历史版本数
+	JOB_HISTORY_LIMIT = 100
+
+	//日历保存目录
+	JOB_CALENDAR_DIR = "/cron/calendars/"
+
+	//集群维护冻结key
+	JOB_FREEZE_KEY = "/cron/freeze"
+
+	//任务最近一次执行过的计划时间目录
+	JOB_LAST_RUN_DIR = "/cron/lastrun/"
+
+	//跳过日志认领目录: /cron/skip/运行ID, 同一次调度只由一个worker记录跳过
+	JOB_SKIP_DIR = "/cron/skip/"
+
+	//已完成分片目录: /cron/sharddone/运行ID/分片序号, 同一次调度的分片不会被执行两次
+	JOB_SHARD_DONE_DIR = "/cron/sharddone/"
+
+	//已完成分片记录的保留时间(秒)
+	JOB_SHARD_DONE_TTL = 3600
+
+	//跳过日志认领key的保留时间(秒), 只需覆盖各worker调度同一时刻的时间差
+	JOB_SKIP_CLAIM_TTL = 60
+
+	//工作流保存目录
+	JOB_WORKFLOW_DIR = "/cron/workflows/"
+
+	//工作流运行记录目录
+	JOB_WORKFLOW_RUN_DIR = "/cron/workflowruns/"
+
+	//工作流运行记录保留时间(秒)
+	JOB_WORKFLOW_RUN_TTL = 7 * 24 * 3600
+
+	//工作流运行默认的超时时间(秒), 超时后还没结束的节点置为失败
+	JOB_WORKFLOW_RUN_TIMEOUT = 24 * 3600
+
+	//worker检查工作流运行是否超时的间隔(秒)
+	JOB_WORKFLOW_CHECK_INTERVAL = 60
+
+	//任务日志的执行状态
+	JOB_STATUS_SUCCESS       = "success"
+	JOB_STATUS_FAILED        = "failed"
+	JOB_STATUS_KILLED        = "killed"
+	JOB_STATUS_TIMEOUT       = "timeout"
+	JOB_STATUS_OOM           = "oom"
+	JOB_STATUS_SKIPPED       = "skipped"
+	JOB_STATUS_LOCK_CONFLICT = "lock-conflict"
+
+	//任务输出默认保留开头和结尾的字节数
+	JOB_OUTPUT_HEAD_BYTES = 64 * 1024
+	JOB_OUTPUT_TAIL_BYTES = 256 * 1024
+
+	//任务输出开头加结尾最多保留的字节数, 合并输出/stdout/stderr各一份, 不能超过mongodb 16MB的文档上限
+	JOB_OUTPUT_MAX_BYTES = 4 * 1024 * 1024
+
+	//强杀任务时SIGTERM后默认等待的秒数, 之后SIGKILL
+	JOB_KILL_GRACE_PERIOD = 10
+
 	//保存任务事件
 	JOB_EVENT_SAVE = 1
 
@@ -27,4 +94,75 @@ const (
 
 	//立即执行任务事件
 	JOB_EVENT_ONCE = 4
+
+	//保存工作流事件
+	JOB_EVENT_WORKFLOW_SAVE = 5
+
+	//删除工作流事件
+	JOB_EVENT_WORKFLOW_DELETE = 6
+
+	//保存日历事件
+	JOB_EVENT_CALENDAR_SAVE = 7
+
+	//删除日历事件
+	JOB_EVENT_CALENDAR_DELETE = 8
+
+	//设置集群冻结事件
+	JOB_EVENT_FREEZE_SAVE = 9
+
+	//解除集群冻结事件
+	JOB_EVENT_FREEZE_CLEAR = 10
+
+	//计算下次调度时间时最多跳过的天数, 避免日历排除了所有日期时死循环
+	SCHEDULE_MAX_SKIP_DAYS = 3660
+
+	//计算下次调度时间时最多跳过的时间窗口次数(每次直接跳到窗口重新满足的时刻)
+	SCHEDULE_MAX_WINDOW_SKIPS = 3660
+
+	//时间窗口类型: 只在窗口内执行 / 窗口内不执行
+	TIME_WINDOW_ALLOW = "allow"
+	TIME_WINDOW_BLOCK = "block"
+
+	//并发策略: 禁止重叠(默认), 允许重叠, 替换旧的执行
+	CONCURRENCY_POLICY_FORBID  = "forbid"
+	CONCURRENCY_POLICY_ALLOW   = "allow"
+	CONCURRENCY_POLICY_REPLACE = "replace"
+
+	//任务修改动作
+	JOB_ACTION_SAVE   = "save"
+	JOB_ACTION_DELETE = "delete"
+
+	//执行模式: 单个worker执行(默认), 所有匹配的worker都执行, 分片执行
+	EXECUTE_MODE_SINGLE    = "single"
+	EXECUTE_MODE_BROADCAST = "broadcast"
+	EXECUTE_MODE_SHARD     = "shard"
+
+	//错过调度的补跑策略: 不补跑(默认), 补跑一次, 全部补跑(有上限)
+	MISFIRE_POLICY_SKIP   = "skip"
+	MISFIRE_POLICY_ONCE   = "run-once"
+	MISFIRE_POLICY_ALL    = "run-all-missed"
+	MISFIRE_DEFAULT_LIMIT = 10
+
+	//调度类型: cron表达式 / 按固定间隔 / 指定时间执行一次
+	SCHEDULE_TYPE_CRON  = "cron"
+	SCHEDULE_TYPE_EVERY = "every"
+	SCHEDULE_TYPE_AT    = "at"
+	SCHEDULE_TYPE_RRULE = "rrule"
+
+	//负载预测: 默认预测24小时, 最多7天; 平均耗时取最近7天的日志
+	FORECAST_DEFAULT_HOURS = 24
+	FORECAST_MAX_HOURS     = 7 * 24
+	FORECAST_HISTORY_DAYS  = 7
+
+	//负载预测时单个任务最多展开的调度次数
+	FORECAST_MAX_RUNS_PER_JOB = 100000
+
+	//任务自身调度字段对应的调度名
+	SCHEDULE_DEFAULT_NAME = "default"
+
+	//工作流运行状态
+	WORKFLOW_STATUS_PENDING = "pending"
+	WORKFLOW_STATUS_RUNNING = "running"
+	WORKFLOW_STATUS_SUCCESS = "success"
+	WORKFLOW_STATUS_FAILED  = "failed"
 )
@@ -6,4 +6,82 @@ var (
 	ERR_LOCK_ALREADY_REQUIRED = errors.New("锁已被占用")
 
 	ERR_NO_LOCAL_IP_FOUND = errors.New("没有找到网卡IP")
+
+	ERR_JOB_TIMEOUT = errors.New("任务执行超时")
+
+	ERR_JOB_RETRY_CANCELED = errors.New("任务重试被取消")
+
+	ERR_WORKER_SHUTDOWN = errors.New("worker退出, 任务被终止")
+
+	ERR_WORKER_STOPPING = errors.New("worker正在退出, 不参与抢锁")
+
+	ERR_JOB_SKIPPED = errors.New("任务正在执行, 跳过本次调度")
+
+	ERR_JOB_NOT_FOUND = errors.New("任务不存在")
+
+	ERR_JOB_REVISION_NOT_FOUND = errors.New("任务历史版本不存在")
+
+	ERR_JOB_REVISION_DELETED = errors.New("该历史版本是删除操作, 无法回滚")
+
+	ERR_SCHEDULE_TYPE = errors.New("调度类型错误, 只支持cron/every/at/rrule")
+
+	ERR_SCHEDULE_INTERVAL = errors.New("调度间隔错误, 应为90s/5m/1h30m这样的正数时长")
+
+	ERR_SCHEDULE_RUN_AT = errors.New("执行时间格式错误, 应为2006-01-02 15:04:05")
+
+	ERR_SCHEDULE_NAME = errors.New("调度名重复")
+
+	ERR_RRULE = errors.New("RRULE格式错误")
+
+	ERR_TIME_WINDOW = errors.New("时间窗口格式错误")
+
+	ERR_CRON_HASH = errors.New("cron表达式中的H格式错误, 支持H/H(a-b)/H/n/H(a-b)/n")
+
+	ERR_CALENDAR_DATE = errors.New("日历日期格式错误, 应为2006-01-02")
+
+	ERR_CALENDAR_NOT_FOUND = errors.New("日历不存在")
+
+	ERR_ICALENDAR_FORMAT = errors.New("iCalendar格式错误")
+
+	ERR_FREEZE_REASON = errors.New("冻结原因不能为空")
+
+	ERR_FREEZE_END_TIME = errors.New("冻结结束时间格式错误或已过期, 应为2006-01-02 15:04:05")
+
+	ERR_RUN_AS_GROUP_WITHOUT_USER = errors.New("设置runAsGroup时必须同时设置runAsUser")
+
+	ERR_RUN_AS_USER_NOT_ALLOWED = errors.New("任务的运行用户不在worker的允许列表中")
+
+	ERR_RUN_AS_GROUP_NOT_ALLOWED = errors.New("任务的运行组不在worker的允许列表中, 且运行用户不属于该组")
+
+	ERR_RUN_AS_NOT_ROOT = errors.New("worker不是以root运行, 不能切换任务的运行用户")
+
+	ERR_DEFAULT_RUN_AS_USER_REQUIRED = errors.New("worker以root运行时必须配置defaultRunAsUser")
+
+	ERR_JOB_OOM = errors.New("任务超出内存限制, 被OOM杀死")
+
+	ERR_CGROUP_DISABLED = errors.New("worker未配置cgroupParent, 不能执行有资源限制的任务")
+
+	ERR_CGROUP_UNSUPPORTED = errors.New("cgroup只支持linux, 不能配置cgroupParent")
+
+	ERR_WORKFLOW_NO_NODE = errors.New("工作流没有节点")
+
+	ERR_WORKFLOW_BAD_EDGE = errors.New("工作流的边引用了不存在的节点")
+
+	ERR_WORKFLOW_CYCLE = errors.New("工作流存在环")
+
+	ERR_WORKFLOW_NOT_FOUND = errors.New("工作流不存在")
+
+	ERR_WORKFLOW_RUN_NOT_FOUND = errors.New("工作流运行记录不存在")
+
+	ERR_WORKFLOW_RUN_EXISTED = errors.New("工作流运行记录已存在")
+
+	ERR_WORKFLOW_NAME = errors.New("工作流名不能为空, 也不能包含/")
+
+	ERR_WORKFLOW_JOB_NOT_FOUND = errors.New("工作流的节点引用了不存在的任务")
+
+	ERR_WORKFLOW_TIMEOUT = errors.New("工作流超时时间错误, 不能为负数, 也不能超过运行记录的保留时间")
+
+	ERR_WORKFLOW_RUN_TIMEOUT = errors.New("工作流运行超时")
+
+	ERR_JOB_PAUSED = errors.New("任务已暂停")
 )
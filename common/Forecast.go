@@ -0,0 +1,126 @@
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+//一次执行占用的worker数: 广播模式每个匹配的worker各执行一次, 分片模式每个分片一个worker
+func buildJobDemand(job *Job, workers []*WorkerInfo) (demand int) {
+	var (
+		worker *WorkerInfo
+	)
+
+	switch job.ExecuteMode {
+	case EXECUTE_MODE_BROADCAST:
+		for _, worker = range workers {
+			if MatchWorker(job, worker.IP, worker.Labels) {
+				demand++
+			}
+		}
+		return
+	case EXECUTE_MODE_SHARD:
+		return job.ShardTotal
+	}
+	return 1
+}
+
+//预测from之后window时长内每分钟的调度数和并发执行数
+//调度时间与worker使用同一套计算(时区/日历/开始停止时间), 暂停的任务不计入
+//durations为各任务(命名空间/任务名)的历史平均耗时
+func BuildLoadForecast(plans []*JobSchedulePlan, durations map[string]time.Duration, workers []*WorkerInfo, from time.Time, window time.Duration) (forecast *LoadForecast) {
+	var (
+		start    time.Time
+		end      time.Time
+		minutes  []LoadForecastMinute
+		plan     *JobSchedulePlan
+		jobName  string
+		duration time.Duration
+		hasStat  bool
+		demand   int
+		next     time.Time
+		runs     int
+		ok       bool
+		first    int
+		last     int
+		i        int
+		jobs     []string
+	)
+
+	start = from.Truncate(time.Minute)
+	end = start.Add(window)
+	minutes = make([]LoadForecastMinute, int(window/time.Minute))
+	for i = range minutes {
+		minutes[i] = LoadForecastMinute{
+			Time: start.Add(time.Duration(i) * time.Minute).In(from.Location()).Format("2006-01-02 15:04"),
+			Jobs: make([]string, 0),
+		}
+	}
+
+	forecast = &LoadForecast{
+		From:          start.Format("2006-01-02 15:04:05"),
+		To:            end.Format("2006-01-02 15:04:05"),
+		WorkerCount:   len(workers),
+		NoHistoryJobs: make([]string, 0),
+		TruncatedJobs: make([]string, 0),
+	}
+
+	for _, plan = range plans {
+		if plan.Job.Paused {
+			continue
+		}
+		forecast.JobCount++
+
+		jobName = BuildJobFullName(plan.Job.Namespace, plan.Job.Name)
+		if duration, hasStat = durations[jobName]; !hasStat {
+			forecast.NoHistoryJobs = append(forecast.NoHistoryJobs, jobName)
+		}
+		demand = buildJobDemand(plan.Job, workers)
+
+		for next, runs = from, 0; runs < FORECAST_MAX_RUNS_PER_JOB; runs++ {
+			if next = BuildNextTime(plan, next); next.IsZero() || !next.Before(end) {
+				break
+			}
+			if ok, _ = CheckJobWindow(plan, next); !ok {
+				continue
+			}
+
+			//同一任务的调度按时间先后计算, 本分钟已列出过就在末尾
+			first = int(next.Sub(start) / time.Minute)
+			minutes[first].Starts++
+			if jobs = minutes[first].Jobs; len(jobs) == 0 || jobs[len(jobs)-1] != jobName {
+				minutes[first].Jobs = append(jobs, jobName)
+			}
+
+			//执行期间覆盖的每一分钟都占用worker, 至少占用启动的那一分钟
+			last = int((next.Add(duration).Sub(start) - 1) / time.Minute)
+			if last < first {
+				last = first
+			}
+			for i = first; i <= last && i < len(minutes); i++ {
+				minutes[i].Demand += demand
+			}
+		}
+
+		//达到上限后的调度没有计入, 预测结果偏低
+		if runs == FORECAST_MAX_RUNS_PER_JOB {
+			forecast.TruncatedJobs = append(forecast.TruncatedJobs, jobName)
+		}
+	}
+
+	for i = range minutes {
+		sort.Strings(minutes[i].Jobs)
+		minutes[i].Overloaded = minutes[i].Demand > len(workers)
+		if minutes[i].Overloaded {
+			forecast.OverloadedNum++
+		}
+		if minutes[i].Starts > forecast.PeakStarts {
+			forecast.PeakStarts = minutes[i].Starts
+		}
+		if minutes[i].Demand > forecast.PeakDemand {
+			forecast.PeakDemand = minutes[i].Demand
+		}
+	}
+	forecast.Minutes = minutes
+	return
+}
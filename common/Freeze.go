@@ -0,0 +1,76 @@
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//反序列化Freeze
+func UnpackFreeze(value []byte) (ret *Freeze, err error) {
+	var (
+		freeze *Freeze
+	)
+
+	freeze = &Freeze{}
+	if err = json.Unmarshal(value, freeze); err != nil {
+		return
+	}
+	ret = freeze
+	return
+}
+
+//冻结变化事件
+func BuildFreezeEvent(eventType int, freeze *Freeze) (jobEvent *JobEvent) {
+	return &JobEvent{
+		EventType: eventType,
+		Freeze:    freeze,
+	}
+}
+
+//冻结是否对所有worker都生效: 按worker标签冻结时, 其他worker可能照常执行
+func IsClusterWideFreeze(freeze *Freeze) bool {
+	return len(freeze.Labels) == 0
+}
+
+//冻结是否对该任务和本机生效
+func CheckFreeze(freeze *Freeze, job *Job, labels map[string]string, now time.Time) (active bool, reason string) {
+	var (
+		key       string
+		value     string
+		namespace string
+		matched   bool
+	)
+
+	if freeze == nil {
+		return
+	}
+
+	//已过结束时间, 等待lease过期删除key
+	if freeze.EndAt != 0 && now.UnixNano()/1000/1000 >= freeze.EndAt {
+		return
+	}
+
+	//命名空间范围
+	if len(freeze.Namespaces) != 0 {
+		for _, namespace = range freeze.Namespaces {
+			if namespace == job.Namespace {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+
+	//worker标签范围
+	for key, value = range freeze.Labels {
+		if labels[key] != value {
+			return
+		}
+	}
+
+	active = true
+	reason = "集群冻结: " + freeze.Reason
+	return
+}
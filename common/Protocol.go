@@ -3,11 +3,16 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/coreos/etcd/clientv3"
 	"github.com/gorhill/cronexpr"
 )
 
@@ -18,31 +23,239 @@ type WorkerSSH struct {
 	Addr string `json:"addr"` //IP地址
 }
 
+//Worker节点注册信息, 作为/cron/workers/IP的值
+type WorkerInfo struct {
+	IP     string            `json:"ip"`     //IP地址
+	Labels map[string]string `json:"labels"` //节点标签
+}
+
 //定时任务
 type Job struct {
-	Name      string `json:"name"`      //任务名
-	Command   string `json:"command"`   //shell命令
-	CronExpr  string `json:"cronExpr"`  //cron表达式
-	Email     string `json:"email"`     //报警邮件
-	StartTime string `json:"startTime"` //任务开始时间
-	StopTime  string `json:"stopTime"`  //任务停止时间
-	Details   string `json:"details"`   //任务详情
+	Namespace         string            `json:"namespace"`                  //命名空间, 为空表示default
+	Name              string            `json:"name"`                       //任务名
+	Command           string            `json:"command"`                    //shell命令
+	CronExpr          string            `json:"cronExpr"`                   //cron表达式
+	Email             string            `json:"email"`                      //报警邮件
+	StartTime         string            `json:"startTime"`                  //任务开始时间
+	StopTime          string            `json:"stopTime"`                   //任务停止时间
+	Details           string            `json:"details"`                    //任务详情
+	Timeout           int               `json:"timeout"`                    //任务超时时间(秒), 0表示不限制
+	KillGracePeriod   int               `json:"killGracePeriod"`            //强杀/超时时SIGTERM后等待多久再SIGKILL(秒), 0表示默认值
+	Retry             RetryPolicy       `json:"retry"`                      //失败重试策略
+	ConcurrencyPolicy string            `json:"concurrencyPolicy"`          //并发策略: forbid, allow, replace
+	MisfirePolicy     string            `json:"misfirePolicy"`              //补跑策略: skip, run-once, run-all-missed
+	MisfireLimit      int               `json:"misfireLimit"`               //run-all-missed最多补跑次数, 0表示默认值
+	Paused            bool              `json:"paused"`                     //是否已暂停
+	PausedBy          string            `json:"pausedBy"`                   //暂停操作人
+	PausedAt          string            `json:"pausedAt"`                   //暂停时间
+	NodeSelector      map[string]string `json:"nodeSelector"`               //节点标签选择器, 为空表示不限制
+	WorkerIds         []string          `json:"workerIds"`                  //允许执行的worker(IP), 为空表示不限制
+	ExecuteMode       string            `json:"executeMode"`                //执行模式: single, broadcast, shard
+	ShardTotal        int               `json:"shardTotal"`                 //shard模式的分片数
+	IncludeCalendars  []string          `json:"includeCalendars"`           //只在这些日历的日期执行, 为空表示不限制
+	ExcludeCalendars  []string          `json:"excludeCalendars"`           //不在这些日历的日期执行
+	Timezone          string            `json:"timezone"`                   //IANA时区名, cron表达式和开始/停止时间都按该时区计算, 为空使用worker本地时区
+	ScheduleType      string            `json:"scheduleType"`               //调度类型cron/every/at, 为空表示cron
+	Interval          string            `json:"interval"`                   //every类型的间隔, 如90s, 从开始时间起算
+	RunAt             string            `json:"runAt"`                      //at类型的执行时间, 格式2006-01-02 15:04:05
+	RRule             string            `json:"rrule"`                      //rrule类型的RFC 5545规则, 如FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1, 从开始时间起算
+	DeleteAfterRun    bool              `json:"deleteAfterRun"`             //at类型执行成功后删除任务, 否则标记为已完成
+	Completed         bool              `json:"completed"`                  //at类型是否已执行成功
+	CompletedAt       string            `json:"completedAt"`                //执行成功的时间
+	ResolvedCronExpr  string            `json:"resolvedCronExpr,omitempty"` //H替换后的cron表达式, 只用于接口展示, 不保存
+	Schedules         []JobSchedule     `json:"schedules"`                  //额外的调度, 与任务自身的调度一起取最早的下次时间
+	TimeWindows       []TimeWindow      `json:"timeWindows"`                //周期性的允许/禁止执行时间窗口, 按任务时区计算
+	RunAsUser         string            `json:"runAsUser"`                  //以该Unix用户执行, 为空使用worker配置的defaultRunAsUser
+	RunAsGroup        string            `json:"runAsGroup"`                 //以该Unix组执行, 为空使用runAsUser的主组
+	Resources         JobResources      `json:"resources"`                  //资源限制, 通过cgroup v2生效
+	OutputLimit       JobOutputLimit    `json:"outputLimit"`                //输出保留的字节数, 覆盖worker的默认值
 }
 
-//任务调度计划
-type JobSchedulePlan struct {
-	Job      *Job                 //要调度的任务信息
+//输出保留开头和结尾各多少字节, 中间的丢弃, 不填表示使用worker的默认值, 0表示不保留
+type JobOutputLimit struct {
+	HeadBytes *int `json:"headBytes,omitempty"` //保留开头的字节数
+	TailBytes *int `json:"tailBytes,omitempty"` //保留结尾的字节数
+}
+
+//任务资源限制, 0表示不限制
+type JobResources struct {
+	MemoryMax int64   `json:"memoryMax"` //内存上限, 单位字节, 超出会被OOM杀死
+	CpuQuota  float64 `json:"cpuQuota"`  //CPU配额, 单位核, 如0.5
+	PidsMax   int64   `json:"pidsMax"`   //进程数上限
+}
+
+//是否设置了资源限制
+func (resources *JobResources) IsLimited() bool {
+	return resources.MemoryMax != 0 || resources.CpuQuota != 0 || resources.PidsMax != 0
+}
+
+//周期性时间窗口, 如周一到周五08:00-20:00
+//结束时间早于开始时间表示跨过零点, 星期按开始的那天算; 开始等于结束表示全天
+type TimeWindow struct {
+	Type  string `json:"type"`  //allow: 只在窗口内执行; block: 窗口内不执行
+	Days  string `json:"days"`  //星期, 如MON-FRI, SAT,SUN, 为空表示每天
+	Start string `json:"start"` //开始时间, 格式15:04
+	End   string `json:"end"`   //结束时间, 格式15:04, 可以是24:00
+}
+
+//解析好的时间窗口
+type JobTimeWindow struct {
+	Type  string  //窗口类型
+	Days  [7]bool //按time.Weekday索引, 是否生效
+	Start int     //开始时间, 当天的分钟数
+	End   int     //结束时间, 当天的分钟数
+}
+
+//任务的一个调度
+type JobSchedule struct {
+	Name             string `json:"name"`                       //调度名, 记录在日志里, 为空时按序号命名
+	ScheduleType     string `json:"scheduleType"`               //调度类型cron/every/at, 为空表示cron
+	CronExpr         string `json:"cronExpr"`                   //cron表达式
+	Interval         string `json:"interval"`                   //every类型的间隔
+	RunAt            string `json:"runAt"`                      //at类型的执行时间
+	RRule            string `json:"rrule"`                      //rrule类型的规则
+	ResolvedCronExpr string `json:"resolvedCronExpr,omitempty"` //H替换后的cron表达式, 只用于接口展示, 不保存
+}
+
+//日历(节假日/排除日期)
+type Calendar struct {
+	Name    string   `json:"name"`    //日历名
+	Dates   []string `json:"dates"`   //日期列表, 格式2006-01-02
+	Details string   `json:"details"` //日历详情
+}
+
+//集群维护冻结, 生效期间worker不启动新的调度
+type Freeze struct {
+	Reason     string            `json:"reason"`     //冻结原因
+	EndTime    string            `json:"endTime"`    //结束时间, 格式2006-01-02 15:04:05, 空表示手动解除
+	EndAt      int64             `json:"endAt"`      //结束时间的毫秒时间戳, master根据EndTime计算
+	Namespaces []string          `json:"namespaces"` //只冻结这些命名空间的任务, 空表示全部
+	Labels     map[string]string `json:"labels"`     //只冻结标签匹配的worker, 空表示全部
+	Author     string            `json:"author"`     //操作人
+	CreatedAt  int64             `json:"createdAt"`  //冻结时间, 毫秒
+}
+
+//下次调度预览
+type JobPreviewTime struct {
+	Time    string `json:"time"`    //调度时间
+	Skipped bool   `json:"skipped"` //是否被跳过
+	Reason  string `json:"reason"`  //跳过原因
+}
+
+//任务历史版本
+type JobRevision struct {
+	Revision  int              `json:"revision"`  //版本号, 从1开始递增
+	Namespace string           `json:"namespace"` //命名空间
+	Name      string           `json:"name"`      //任务名
+	Action    string           `json:"action"`    //save, delete
+	Author    string           `json:"author"`    //操作人
+	Time      string           `json:"time"`      //操作时间
+	Job       *Job             `json:"job"`       //该版本的任务定义, 删除操作为nil
+	Diff      []JobFieldChange `json:"diff"`      //与上一个定义的差异
+}
+
+//任务字段的变化
+type JobFieldChange struct {
+	Field string      `json:"field"` //字段名(json)
+	Old   interface{} `json:"old"`   //旧值
+	New   interface{} `json:"new"`   //新值
+}
+
+//任务失败重试策略
+type RetryPolicy struct {
+	MaxAttempts        int     `json:"maxAttempts"`        //最大尝试次数(含首次), 0或1表示不重试
+	InitialDelay       int     `json:"initialDelay"`       //首次重试间隔(秒)
+	BackoffFactor      float64 `json:"backoffFactor"`      //退避倍数, 0表示固定间隔
+	RetryableExitCodes []int   `json:"retryableExitCodes"` //可重试的退出码, 为空表示任意失败都重试
+}
+
+//工作流(任务依赖DAG)
+type Workflow struct {
+	Name     string         `json:"name"`     //工作流名
+	CronExpr string         `json:"cronExpr"` //根节点的cron表达式, 为空表示只能手动触发
+	Nodes    []string       `json:"nodes"`    //节点(命名空间/任务名)
+	Edges    []WorkflowEdge `json:"edges"`    //依赖边
+	Details  string         `json:"details"`  //工作流详情
+	Timeout  int            `json:"timeout"`  //运行超时时间(秒), 超时后没结束的节点置为失败, 0表示默认24小时
+}
+
+//工作流依赖边: From成功后触发To
+type WorkflowEdge struct {
+	From string `json:"from"` //上游任务名
+	To   string `json:"to"`   //下游任务名
+}
+
+//工作流运行记录
+type WorkflowRun struct {
+	RunId        string                      `json:"runId"`        //运行ID
+	WorkflowName string                      `json:"workflowName"` //工作流名
+	Workflow     *Workflow                   `json:"workflow"`     //运行时的工作流定义
+	Status       string                      `json:"status"`       //整体状态
+	NodeStatus   map[string]string           `json:"nodeStatus"`   //每个节点的状态
+	NodeRuns     map[string]*WorkflowNodeRun `json:"nodeRuns"`     //每个节点的执行情况
+	PlanTime     int64                       `json:"planTime"`     //计划开始时间
+	StartTime    int64                       `json:"startTime"`    //开始时间
+	EndTime      int64                       `json:"endTime"`      //结束时间
+	Deadline     int64                       `json:"deadline"`     //超时时间, 到期还没结束的节点置为失败
+}
+
+//工作流节点的执行情况, 由实际执行的worker记录
+type WorkflowNodeRun struct {
+	Worker    string `json:"worker"`    //执行节点的worker
+	StartTime int64  `json:"startTime"` //开始时间
+	EndTime   int64  `json:"endTime"`   //结束时间
+	Err       string `json:"err"`       //失败原因
+}
+
+//工作流触发信息, 作为/cron/once/任务名的值
+type WorkflowTrigger struct {
+	WorkflowName string `json:"workflowName"` //工作流名
+	RunId        string `json:"runId"`        //运行ID
+}
+
+//工作流调度计划
+type WorkflowSchedulePlan struct {
+	Workflow *Workflow            //要调度的工作流
 	Expr     *cronexpr.Expression //解析好的cronexpr表达式
 	NextTime time.Time            //下次调度时间
 }
 
+//任务调度计划
+type JobSchedulePlan struct {
+	Job          *Job                 //要调度的任务信息
+	Schedules    []*JobScheduleEntry  //解析好的各个调度
+	NextTime     time.Time            //下次调度时间
+	MisfireTimes []time.Time          //待补跑的计划时间, 按时间先后排列
+	Calendars    map[string]*Calendar //计算调度时间用到的日历表
+	Location     *time.Location       //任务时区
+	TimeWindows  []*JobTimeWindow     //解析好的时间窗口
+}
+
+//解析好的一个调度
+type JobScheduleEntry struct {
+	Name         string               //调度名
+	ScheduleType string               //调度类型
+	Expr         *cronexpr.Expression //解析好的cronexpr表达式, cron类型才有
+	Interval     time.Duration        //every类型的间隔
+	Anchor       time.Time            //every类型的起算时间
+	RunAt        time.Time            //at类型的执行时间
+	RRule        *RRule               //解析好的RRULE, rrule类型才有
+}
+
 //任务执行状态
 type JobExecuteInfo struct {
 	Job        *Job               //任务信息
 	PlanTime   time.Time          //理论上的调度时间
+	Schedule   string             //触发本次执行的调度名, 立即执行为空
+	IsOnce     bool               //是否是立即执行
+	RunId      string             //运行ID, 同一次调度在各worker上相同
+	ShardIndex int                //shard模式下抢到的分片序号
 	RealTime   time.Time          //实际的调度时间
-	CancelCtx  context.Context    //任务command的context
+	CancelCtx  context.Context    //任务command的context, 强杀或替换时取消
 	CancelFunc context.CancelFunc //用于取消command执行的cancel函数
+	Trigger    *WorkflowTrigger   //所属的工作流运行, 非工作流触发为nil
+	Replaces   *JobExecuteInfo    //replace策略下被本次执行替换掉的旧执行
+	Done       chan struct{}      //执行结束并释放锁后关闭
 }
 
 //http接口应答
@@ -54,31 +267,110 @@ type Response struct {
 
 //变化事件
 type JobEvent struct {
-	EventType int //SAVE, DELETE
-	Job       *Job
+	EventType    int //SAVE, DELETE
+	Job          *Job
+	LastPlanTime time.Time        //启动时加载的最近一次执行过的计划时间, 用于补跑
+	Workflow     *Workflow        //工作流事件才有
+	Trigger      *WorkflowTrigger //工作流触发的立即执行事件才有
+	OnceId       string           //立即执行事件的标识(once key的修订号), 各worker收到的相同
+	Calendar     *Calendar        //日历事件才有
+	Freeze       *Freeze          //冻结事件才有
 }
 
 //任务执行结果
 type JobExecuteResult struct {
 	ExecuteInfo *JobExecuteInfo //执行状态
-	Output      []byte          //脚本输出
+	Stdout      []byte          //标准输出
+	Stderr      []byte          //标准错误
+	StdoutBytes int64           //标准输出的总字节数
+	StderrBytes int64           //标准错误的总字节数
+	Truncated   bool            //输出是否超出保留长度被截断
 	Err         error           //脚本错误原因
+	ExitCode    int             //脚本退出码
+	IsTimeout   bool            //是否因超时被终止
+	IsRejected  bool            //是否被worker拒绝执行(如运行用户不在允许列表中)或因worker退出被终止, 不重试
+	Signal      string          //结束任务的信号, 如SIGTERM/SIGKILL
+	IsOOM       bool            //是否因超出内存限制被OOM杀死
+	IsKilled    bool            //是否被强杀、替换或worker退出终止
+	Attempt     int             //第几次尝试(从1开始)
+	WillRetry   bool            //是否还会重试
 	StartTime   time.Time       //启动时间
 	EndTime     time.Time       //结束时间
 }
 
 //任务执行日志
 type JobLog struct {
+	Namespace    string `json:"namespace" bson:"namespace"`       //命名空间
 	JobName      string `json:"jobName" bson:"jobName"`           //任务名字
 	Command      string `json:"command" bson:"command"`           //脚本命令
 	Err          string `json:"err" bson:"err"`                   //错误原因
-	Output       string `json:"output" bson:"output"`             //脚本输出
+	Output       string `json:"output" bson:"output,omitempty"`   //脚本输出, 只有分开记录stdout/stderr之前的旧日志才有
+	Stdout       string `json:"stdout" bson:"stdout"`             //标准输出
+	Stderr       string `json:"stderr" bson:"stderr"`             //标准错误
+	StdoutBytes  int64  `json:"stdoutBytes" bson:"stdoutBytes"`   //标准输出的总字节数
+	StderrBytes  int64  `json:"stderrBytes" bson:"stderrBytes"`   //标准错误的总字节数
+	Truncated    bool   `json:"truncated" bson:"truncated"`       //输出是否超出保留长度被截断, 只保留了开头和结尾
+	ExitCode     int    `json:"exitCode" bson:"exitCode"`         //退出码, 没能正常退出为-1
+	Status       string `json:"status" bson:"status"`             //执行状态: success, failed, killed, timeout, oom, skipped, lock-conflict
 	PlanTime     int64  `json:"planTime" bson:"planTime"`         //计划开始时间
 	ScheduleTime int64  `json:"scheduleTime" bson:"scheduleTime"` //实际调度时间
 	StartTime    int64  `json:"startTime" bson:"startTime"`       //任务执行开始时间
 	EndTime      int64  `json:"endTime" bson:"endTime"`           //任务执行结束时间
 	LocalIP      string `json:"localIP" bson:"localIP"`           //工作Worker节点IP
 	Email        string `json:"email" bson:"email"`               //报警邮箱
+	IsTimeout    bool   `json:"isTimeout" bson:"isTimeout"`       //是否因超时被终止
+	IsOOM        bool   `json:"isOOM" bson:"isOOM"`               //是否因超出内存限制被OOM杀死
+	Signal       string `json:"signal" bson:"signal"`             //结束任务的信号, 如SIGTERM/SIGKILL, 正常退出为空
+	Attempt      int    `json:"attempt" bson:"attempt"`           //第几次尝试(从1开始)
+	IsSkipped    bool   `json:"isSkipped" bson:"isSkipped"`       //是否跳过了本次调度
+	RunId        string `json:"runId" bson:"runId"`               //运行ID, 广播和分片的各个结果共享
+	ShardIndex   int    `json:"shardIndex" bson:"shardIndex"`     //分片序号
+	ShardTotal   int    `json:"shardTotal" bson:"shardTotal"`     //分片总数, 非分片模式为0
+	Schedule     string `json:"schedule" bson:"schedule"`         //触发本次执行的调度名
+}
+
+//任务历史平均耗时(mongodb聚合结果)
+type JobDurationStat struct {
+	Id struct {
+		Namespace string `bson:"namespace"`
+		JobName   string `bson:"jobName"`
+	} `bson:"_id"`
+	AvgDuration float64 `bson:"avgDuration"` //平均耗时(毫秒)
+}
+
+//集群调度负载预测
+type LoadForecast struct {
+	From          string               `json:"from"`          //预测开始时间
+	To            string               `json:"to"`            //预测结束时间
+	WorkerCount   int                  `json:"workerCount"`   //在线worker数
+	JobCount      int                  `json:"jobCount"`      //参与预测的任务数
+	NoHistoryJobs []string             `json:"noHistoryJobs"` //没有历史耗时的任务, 按在启动的那一分钟内结束估算
+	TruncatedJobs []string             `json:"truncatedJobs"` //调度次数达到上限的任务, 之后的调度没有计入
+	PeakStarts    int                  `json:"peakStarts"`    //单分钟最多启动次数
+	PeakDemand    int                  `json:"peakDemand"`    //单分钟最多并发执行数
+	OverloadedNum int                  `json:"overloadedNum"` //并发执行数超过worker数的分钟数
+	Minutes       []LoadForecastMinute `json:"minutes"`       //每分钟的统计
+}
+
+//一分钟的负载预测
+type LoadForecastMinute struct {
+	Time       string   `json:"time"`       //分钟, 格式2006-01-02 15:04
+	Starts     int      `json:"starts"`     //计划启动次数
+	Demand     int      `json:"demand"`     //估算的并发执行数(按历史平均耗时)
+	Overloaded bool     `json:"overloaded"` //并发执行数是否超过在线worker数
+	Jobs       []string `json:"jobs"`       //本分钟启动的任务, 每个任务只列一次, 启动次数见starts
+}
+
+//一次运行的汇总结果(广播和分片模式下由多条日志组成)
+type JobRunSummary struct {
+	RunId      string    `json:"runId"`      //运行ID
+	JobName    string    `json:"jobName"`    //任务名字
+	Total      int       `json:"total"`      //结果条数
+	SuccessNum int       `json:"successNum"` //成功条数
+	FailedNum  int       `json:"failedNum"`  //失败条数
+	SkippedNum int       `json:"skippedNum"` //跳过条数, 不算失败
+	Success    bool      `json:"success"`    //整体是否成功
+	Logs       []*JobLog `json:"logs"`       //各个结果
 }
 
 //日志批次
@@ -86,9 +378,19 @@ type LogBatch struct {
 	Logs []interface{} //多条日志
 }
 
-//任务日志过滤条件
-type JobLogFilter struct {
-	JobName string `bson:"jobName"`
+//任务日志查询条件, 为空的条件不过滤
+type JobLogQuery struct {
+	Name     string //命名空间/任务名
+	Status   string //执行状态
+	ExitCode *int   //退出码, nil表示不过滤
+	Signal   string //结束任务的信号
+	Stdout   string //标准输出包含的内容
+	Stderr   string //标准错误包含的内容
+}
+
+//按运行ID过滤日志
+type JobRunLogFilter struct {
+	RunId string `bson:"runId"`
 }
 
 //任务日志排序规则
@@ -122,26 +424,177 @@ func UnpackJob(value []byte) (ret *Job, err error) {
 	if err = json.Unmarshal(value, job); err != nil {
 		return
 	}
+	if job.Namespace == "" {
+		job.Namespace = JOB_DEFAULT_NAMESPACE
+	}
 	ret = job
 	return
 }
 
-//从etcd的key中提取任务名
-///cron/jobs/job10抹掉/cron/jobs/
+//任务历史版本的key, 版本号补零保证按key排序即按版本排序
+func BuildJobHistoryKey(fullName string, revision int) string {
+	return JOB_HISTORY_DIR + fullName + "/" + fmt.Sprintf("%010d", revision)
+}
+
+//任务最新的历史版本号, 没有历史时为0, master和worker共用
+func LastJobRevision(kv clientv3.KV, fullName string) (revision int, err error) {
+	var (
+		getResp *clientv3.GetResponse
+	)
+
+	if getResp, err = kv.Get(context.TODO(), JOB_HISTORY_DIR+fullName+"/", append(clientv3.WithLastKey(), clientv3.WithPrefix())...); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		return
+	}
+	revision, err = strconv.Atoi(strings.TrimPrefix(string(getResp.Kvs[0].Key), JOB_HISTORY_DIR+fullName+"/"))
+	return
+}
+
+//只保留最近的JOB_HISTORY_LIMIT个历史版本
+func PruneJobHistory(kv clientv3.KV, fullName string, revision int) {
+	if revision <= JOB_HISTORY_LIMIT {
+		return
+	}
+	kv.Delete(context.TODO(), JOB_HISTORY_DIR+fullName+"/",
+		clientv3.WithRange(BuildJobHistoryKey(fullName, revision-JOB_HISTORY_LIMIT+1)))
+}
+
+//对比两个任务定义, 返回有变化的字段, 任务不存在时传nil
+func BuildJobDiff(oldJob *Job, newJob *Job) (diff []JobFieldChange) {
+	var (
+		oldFields map[string]interface{}
+		newFields map[string]interface{}
+		fields    []string
+		field     string
+		value     []byte
+	)
+
+	oldFields = make(map[string]interface{})
+	newFields = make(map[string]interface{})
+	if oldJob != nil {
+		value, _ = json.Marshal(oldJob)
+		json.Unmarshal(value, &oldFields)
+	}
+	if newJob != nil {
+		value, _ = json.Marshal(newJob)
+		json.Unmarshal(value, &newFields)
+	}
+
+	//按字段名排序, 保证输出稳定
+	for field = range oldFields {
+		fields = append(fields, field)
+	}
+	for field = range newFields {
+		if _, ok := oldFields[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	diff = make([]JobFieldChange, 0)
+	for _, field = range fields {
+		if !reflect.DeepEqual(oldFields[field], newFields[field]) {
+			diff = append(diff, JobFieldChange{Field: field, Old: oldFields[field], New: newFields[field]})
+		}
+	}
+	return
+}
+
+//带命名空间的任务名: 命名空间/任务名
+func BuildJobFullName(namespace string, name string) string {
+	if namespace == "" {
+		namespace = JOB_DEFAULT_NAMESPACE
+	}
+	return namespace + "/" + name
+}
+
+//拆分带命名空间的任务名, 不带命名空间的属于default
+func ExtractJobNamespace(fullName string) (namespace string, name string) {
+	var (
+		idx int
+	)
+
+	if idx = strings.Index(fullName, "/"); idx < 0 {
+		return JOB_DEFAULT_NAMESPACE, fullName
+	}
+	return fullName[:idx], fullName[idx+1:]
+}
+
+//补全任务名的命名空间
+func NormalizeJobFullName(fullName string) string {
+	return BuildJobFullName(ExtractJobNamespace(fullName))
+}
+
+//命名空间和任务名不能为空, 也不能包含/
+func VerifyJobName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+//反序列化Workflow
+func UnpackWorkflow(value []byte) (ret *Workflow, err error) {
+	var (
+		workflow *Workflow
+	)
+
+	workflow = &Workflow{}
+	if err = json.Unmarshal(value, workflow); err != nil {
+		return
+	}
+	ret = workflow
+	return
+}
+
+//反序列化WorkflowTrigger, 空值表示普通的立即执行
+func UnpackWorkflowTrigger(value []byte) (ret *WorkflowTrigger, err error) {
+	var (
+		trigger *WorkflowTrigger
+	)
+
+	if len(value) == 0 {
+		return
+	}
+
+	trigger = &WorkflowTrigger{}
+	if err = json.Unmarshal(value, trigger); err != nil {
+		return
+	}
+	ret = trigger
+	return
+}
+
+//从etcd的key中提取带命名空间的任务名
+///cron/jobs/default/job10抹掉/cron/jobs/
 func ExtractJobName(jobKey string) string {
 	return strings.TrimPrefix(jobKey, JOB_SAVE_DIR)
 }
 
-//从/cron/killer/job10提取job10
+//从/cron/killer/default/job10提取default/job10
 func ExtractKillerName(killerKey string) string {
 	return strings.TrimPrefix(killerKey, JOB_KILLER_DIR)
 }
 
-//从/cron/once/job1提取job1
+//从/cron/once/default/job1提取default/job1
 func ExtractOnceName(OnceKey string) string {
 	return strings.TrimPrefix(OnceKey, JOB_ONCE_DIR)
 }
 
+//从/cron/lastrun/default/job1提取default/job1
+func ExtractLastRunName(lastRunKey string) string {
+	return strings.TrimPrefix(lastRunKey, JOB_LAST_RUN_DIR)
+}
+
+//从/cron/workflows/etl提取etl
+func ExtractWorkflowName(workflowKey string) string {
+	return strings.TrimPrefix(workflowKey, JOB_WORKFLOW_DIR)
+}
+
+//工作流运行记录的key: /cron/workflowruns/工作流名/运行ID
+func BuildWorkflowRunKey(workflowName string, runId string) string {
+	return JOB_WORKFLOW_RUN_DIR + workflowName + "/" + runId
+}
+
 //任务变化事件有2种：1）更新任务 2）删除任务
 func BuildJobEvent(eventType int, job *Job) (jobEvent *JobEvent) {
 	return &JobEvent{
@@ -150,37 +603,526 @@ func BuildJobEvent(eventType int, job *Job) (jobEvent *JobEvent) {
 	}
 }
 
-//构造任务执行计划
-func BuildJobSchedulePlan(job *Job) (jobSchedulePlan *JobSchedulePlan, err error) {
+//工作流变化事件
+func BuildWorkflowEvent(eventType int, workflow *Workflow) (jobEvent *JobEvent) {
+	return &JobEvent{
+		EventType: eventType,
+		Workflow:  workflow,
+	}
+}
+
+//工作流的节点统一为带命名空间的任务名
+func NormalizeWorkflow(workflow *Workflow) {
+	var (
+		i int
+	)
+
+	for i = range workflow.Nodes {
+		workflow.Nodes[i] = NormalizeJobFullName(workflow.Nodes[i])
+	}
+	for i = range workflow.Edges {
+		workflow.Edges[i].From = NormalizeJobFullName(workflow.Edges[i].From)
+		workflow.Edges[i].To = NormalizeJobFullName(workflow.Edges[i].To)
+	}
+}
+
+//校验工作流: 名字合法, 至少一个节点, 边引用的节点存在, 不存在环
+func VerifyWorkflow(workflow *Workflow) (err error) {
+	var (
+		nodeSet  map[string]bool
+		inDegree map[string]int
+		edge     WorkflowEdge
+		node     string
+		queue    []string
+		visited  int
+	)
+
+	if !VerifyJobName(workflow.Name) {
+		err = ERR_WORKFLOW_NAME
+		return
+	}
+
+	if workflow.Timeout < 0 || workflow.Timeout > JOB_WORKFLOW_RUN_TTL {
+		err = ERR_WORKFLOW_TIMEOUT
+		return
+	}
+
+	if len(workflow.Nodes) == 0 {
+		err = ERR_WORKFLOW_NO_NODE
+		return
+	}
+
+	nodeSet = make(map[string]bool)
+	inDegree = make(map[string]int)
+	for _, node = range workflow.Nodes {
+		nodeSet[node] = true
+		inDegree[node] = 0
+	}
+
+	for _, edge = range workflow.Edges {
+		if !nodeSet[edge.From] || !nodeSet[edge.To] {
+			err = ERR_WORKFLOW_BAD_EDGE
+			return
+		}
+		inDegree[edge.To]++
+	}
+
+	//拓扑排序, 能访问到所有节点说明无环
+	queue = BuildWorkflowRoots(workflow)
+	for len(queue) != 0 {
+		node = queue[0]
+		queue = queue[1:]
+		visited++
+		for _, edge = range workflow.Edges {
+			if edge.From == node {
+				if inDegree[edge.To]--; inDegree[edge.To] == 0 {
+					queue = append(queue, edge.To)
+				}
+			}
+		}
+	}
+	if visited != len(nodeSet) {
+		err = ERR_WORKFLOW_CYCLE
+	}
+	return
+}
+
+//工作流的根节点(没有上游的节点)
+func BuildWorkflowRoots(workflow *Workflow) (roots []string) {
+	var (
+		hasUpstream map[string]bool
+		edge        WorkflowEdge
+		node        string
+	)
+
+	hasUpstream = make(map[string]bool)
+	for _, edge = range workflow.Edges {
+		hasUpstream[edge.To] = true
+	}
+	for _, node = range StrSliceRemoveRepeat(workflow.Nodes) {
+		if !hasUpstream[node] {
+			roots = append(roots, node)
+		}
+	}
+	return
+}
+
+//构造一次工作流运行记录, 根节点置为running
+func BuildWorkflowRun(workflow *Workflow, runId string, planTime time.Time) (workflowRun *WorkflowRun) {
+	var (
+		node    string
+		now     time.Time
+		timeout int
+	)
+
+	if timeout = workflow.Timeout; timeout == 0 {
+		timeout = JOB_WORKFLOW_RUN_TIMEOUT
+	}
+
+	now = time.Now()
+	workflowRun = &WorkflowRun{
+		RunId:        runId,
+		WorkflowName: workflow.Name,
+		Workflow:     workflow,
+		Status:       WORKFLOW_STATUS_RUNNING,
+		NodeStatus:   make(map[string]string),
+		NodeRuns:     make(map[string]*WorkflowNodeRun),
+		PlanTime:     planTime.UnixNano() / 1000 / 1000,
+		StartTime:    now.UnixNano() / 1000 / 1000,
+		Deadline:     now.Add(time.Duration(timeout)*time.Second).UnixNano() / 1000 / 1000,
+	}
+	for _, node = range workflow.Nodes {
+		workflowRun.NodeStatus[node] = WORKFLOW_STATUS_PENDING
+	}
+	for _, node = range BuildWorkflowRoots(workflow) {
+		workflowRun.NodeStatus[node] = WORKFLOW_STATUS_RUNNING
+	}
+	return
+}
+
+//记录工作流节点开始执行, 节点不在运行中或已记录过时返回false
+func StartWorkflowNode(workflowRun *WorkflowRun, jobName string, worker string) bool {
+	if workflowRun.NodeStatus[jobName] != WORKFLOW_STATUS_RUNNING {
+		return false
+	}
+	if workflowRun.NodeRuns == nil {
+		workflowRun.NodeRuns = make(map[string]*WorkflowNodeRun)
+	}
+	if workflowRun.NodeRuns[jobName] != nil {
+		return false
+	}
+	workflowRun.NodeRuns[jobName] = &WorkflowNodeRun{
+		Worker:    worker,
+		StartTime: time.Now().UnixNano() / 1000 / 1000,
+	}
+	return true
+}
+
+//更新工作流节点结果, reason为失败原因, 返回因此可以触发的下游节点
+func UpdateWorkflowRun(workflowRun *WorkflowRun, jobName string, worker string, success bool, reason string) (readyNodes []string) {
+	var (
+		edge     WorkflowEdge
+		upstream WorkflowEdge
+		ready    bool
+		status   string
+		finished bool
+		nodeRun  *WorkflowNodeRun
+		now      int64
+	)
+
+	//节点不在运行中, 重复的结果直接忽略
+	if workflowRun.NodeStatus[jobName] != WORKFLOW_STATUS_RUNNING {
+		return
+	}
+
+	//记录节点的执行情况, 没有开始记录的(如被跳过)以结束时间为开始时间
+	now = time.Now().UnixNano() / 1000 / 1000
+	if workflowRun.NodeRuns == nil {
+		workflowRun.NodeRuns = make(map[string]*WorkflowNodeRun)
+	}
+	if nodeRun = workflowRun.NodeRuns[jobName]; nodeRun == nil {
+		nodeRun = &WorkflowNodeRun{Worker: worker, StartTime: now}
+		workflowRun.NodeRuns[jobName] = nodeRun
+	}
+	nodeRun.EndTime = now
+	nodeRun.Err = reason
+
+	if !success {
+		workflowRun.NodeStatus[jobName] = WORKFLOW_STATUS_FAILED
+		workflowRun.Status = WORKFLOW_STATUS_FAILED
+		workflowRun.EndTime = time.Now().UnixNano() / 1000 / 1000
+		return
+	}
+	workflowRun.NodeStatus[jobName] = WORKFLOW_STATUS_SUCCESS
+
+	//工作流已经失败, 不再触发下游
+	if workflowRun.Status != WORKFLOW_STATUS_RUNNING {
+		return
+	}
+
+	//上游全部成功的下游节点可以触发
+	for _, edge = range workflowRun.Workflow.Edges {
+		if edge.From != jobName || workflowRun.NodeStatus[edge.To] != WORKFLOW_STATUS_PENDING {
+			continue
+		}
+		ready = true
+		for _, upstream = range workflowRun.Workflow.Edges {
+			if upstream.To == edge.To && workflowRun.NodeStatus[upstream.From] != WORKFLOW_STATUS_SUCCESS {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			workflowRun.NodeStatus[edge.To] = WORKFLOW_STATUS_RUNNING
+			readyNodes = append(readyNodes, edge.To)
+		}
+	}
+
+	//所有节点都成功, 整个工作流成功
+	finished = true
+	for _, status = range workflowRun.NodeStatus {
+		if status != WORKFLOW_STATUS_SUCCESS {
+			finished = false
+			break
+		}
+	}
+	if finished {
+		workflowRun.Status = WORKFLOW_STATUS_SUCCESS
+		workflowRun.EndTime = time.Now().UnixNano() / 1000 / 1000
+	}
+	return
+}
+
+//运行超时的工作流: 还在运行的节点置为失败, 整个工作流失败, 没有超时返回false
+func ExpireWorkflowRun(workflowRun *WorkflowRun, now time.Time) (expired bool) {
+	var (
+		deadline int64
+		node     string
+		status   string
+		nowMs    int64
+	)
+
+	if workflowRun.Status != WORKFLOW_STATUS_RUNNING {
+		return
+	}
+
+	//旧的运行记录没有超时时间, 按默认超时时间计算
+	if deadline = workflowRun.Deadline; deadline == 0 {
+		deadline = workflowRun.StartTime + JOB_WORKFLOW_RUN_TIMEOUT*1000
+	}
+	nowMs = now.UnixNano() / 1000 / 1000
+	if nowMs < deadline {
+		return
+	}
+
+	if workflowRun.NodeRuns == nil {
+		workflowRun.NodeRuns = make(map[string]*WorkflowNodeRun)
+	}
+	for node, status = range workflowRun.NodeStatus {
+		if status != WORKFLOW_STATUS_RUNNING {
+			continue
+		}
+		workflowRun.NodeStatus[node] = WORKFLOW_STATUS_FAILED
+		if workflowRun.NodeRuns[node] == nil {
+			workflowRun.NodeRuns[node] = &WorkflowNodeRun{StartTime: nowMs}
+		}
+		workflowRun.NodeRuns[node].EndTime = nowMs
+		workflowRun.NodeRuns[node].Err = ERR_WORKFLOW_RUN_TIMEOUT.Error()
+	}
+	workflowRun.Status = WORKFLOW_STATUS_FAILED
+	workflowRun.EndTime = nowMs
+	expired = true
+	return
+}
+
+//通过/cron/once/任务名触发工作流节点, 值为工作流触发信息, master手动触发和worker触发下游共用
+func OnceWorkflowNode(kv clientv3.KV, lease clientv3.Lease, workflowRun *WorkflowRun, jobName string) (err error) {
+	var (
+		triggerValue   []byte
+		leaseGrantResp *clientv3.LeaseGrantResponse
+	)
+
+	if triggerValue, err = json.Marshal(&WorkflowTrigger{WorkflowName: workflowRun.WorkflowName, RunId: workflowRun.RunId}); err != nil {
+		return
+	}
+
+	//让worker监听到一次put操作, 1s后过期
+	if leaseGrantResp, err = lease.Grant(context.TODO(), 1); err != nil {
+		return
+	}
+	_, err = kv.Put(context.TODO(), JOB_ONCE_DIR+jobName, string(triggerValue), clientv3.WithLease(leaseGrantResp.ID))
+	return
+}
+
+//构造工作流调度计划
+func BuildWorkflowSchedulePlan(workflow *Workflow) (workflowSchedulePlan *WorkflowSchedulePlan, err error) {
 	var (
 		expr *cronexpr.Expression
 	)
 
-	//解析JOB的cron表达式
-	if expr, err = cronexpr.Parse(job.CronExpr); err != nil {
+	//解析工作流的cron表达式
+	if expr, err = cronexpr.Parse(workflow.CronExpr); err != nil {
 		return
 	}
 
-	//生成任务调度计划对象
-	jobSchedulePlan = &JobSchedulePlan{
-		Job:      job,
+	//生成工作流调度计划对象
+	workflowSchedulePlan = &WorkflowSchedulePlan{
+		Workflow: workflow,
 		Expr:     expr,
 		NextTime: expr.Next(time.Now()),
 	}
 	return
 }
 
+//构造任务执行计划
+func BuildJobSchedulePlan(job *Job) (jobSchedulePlan *JobSchedulePlan, err error) {
+	//生成任务调度计划对象
+	jobSchedulePlan = &JobSchedulePlan{
+		Job: job,
+	}
+
+	//任务时区
+	if jobSchedulePlan.Location, err = BuildJobLocation(job); err != nil {
+		return
+	}
+
+	//解析所有调度
+	if jobSchedulePlan.Schedules, err = buildJobScheduleEntries(job, jobSchedulePlan.Location); err != nil {
+		return
+	}
+
+	//解析时间窗口
+	if jobSchedulePlan.TimeWindows, err = ParseTimeWindows(job.TimeWindows); err != nil {
+		return
+	}
+
+	jobSchedulePlan.NextTime = BuildNextTime(jobSchedulePlan, time.Now())
+	return
+}
+
+//任务最多补跑的次数, 0表示不补跑
+func BuildMisfireLimit(job *Job) (limit int) {
+	switch job.MisfirePolicy {
+	case MISFIRE_POLICY_ONCE:
+		limit = 1
+	case MISFIRE_POLICY_ALL:
+		if limit = job.MisfireLimit; limit <= 0 {
+			limit = MISFIRE_DEFAULT_LIMIT
+		}
+	}
+	return
+}
+
+//检查任务的输出保留长度: 不填或0都合法, 负数和总长超出上限不合法
+func CheckJobOutputLimit(outputLimit *JobOutputLimit) bool {
+	var (
+		total int
+	)
+
+	for _, bytes := range []*int{outputLimit.HeadBytes, outputLimit.TailBytes} {
+		if bytes == nil {
+			continue
+		}
+		if *bytes < 0 {
+			return false
+		}
+		total += *bytes
+	}
+	return total <= JOB_OUTPUT_MAX_BYTES
+}
+
+//计算(from, now]之间错过的计划时间, 按任务的补跑策略截取
+func BuildMisfireTimes(jobSchedulePlan *JobSchedulePlan, from time.Time, now time.Time) (misfireTimes []time.Time) {
+	var (
+		limit    int
+		planTime time.Time
+	)
+
+	if limit = BuildMisfireLimit(jobSchedulePlan.Job); limit == 0 {
+		return
+	}
+
+	//只保留最近的limit次
+	for planTime = BuildNextTime(jobSchedulePlan, from); !planTime.IsZero() && !planTime.After(now); planTime = BuildNextTime(jobSchedulePlan, planTime) {
+		misfireTimes = append(misfireTimes, planTime)
+		if len(misfireTimes) > limit {
+			misfireTimes = misfireTimes[1:]
+		}
+	}
+	return
+}
+
 //构造执行状态信息
-func BuildJobExecuteInfo(jobSchedulePlan *JobSchedulePlan) (jobExecuteInfo *JobExecuteInfo) {
+func BuildJobExecuteInfo(jobSchedulePlan *JobSchedulePlan, planTime time.Time) (jobExecuteInfo *JobExecuteInfo) {
 	jobExecuteInfo = &JobExecuteInfo{
 		Job:      jobSchedulePlan.Job,
-		PlanTime: jobSchedulePlan.NextTime, //计算调度时间
-		RealTime: time.Now(),               //真实调度时间
+		PlanTime: planTime,                                     //计算调度时间
+		Schedule: BuildScheduleName(jobSchedulePlan, planTime), //触发的调度
+		RealTime: time.Now(),                                   //真实调度时间
+		RunId:    BuildJobRunId(jobSchedulePlan.Job, planTime),
+		Done:     make(chan struct{}),
 	}
+	//强杀或替换时取消, 超时在每次启动命令时单独计算
 	jobExecuteInfo.CancelCtx, jobExecuteInfo.CancelFunc = context.WithCancel(context.TODO())
 	return
 }
 
+//一次命令执行的context, 设置了超时时间的任务从命令启动时开始计时, 等锁和重试退避的时间不算在内
+func BuildCommandContext(jobExecuteInfo *JobExecuteInfo) (ctx context.Context, cancelFunc context.CancelFunc) {
+	if jobExecuteInfo.Job.Timeout > 0 {
+		return context.WithTimeout(jobExecuteInfo.CancelCtx, time.Duration(jobExecuteInfo.Job.Timeout)*time.Second)
+	}
+	return context.WithCancel(jobExecuteInfo.CancelCtx)
+}
+
+//定时调度的运行ID: 命名空间/任务名-计划时间(毫秒)
+func BuildJobRunId(job *Job, planTime time.Time) string {
+	return BuildJobFullName(job.Namespace, job.Name) + "-" + strconv.FormatInt(planTime.UnixNano()/1000/1000, 10)
+}
+
+//立即执行的运行ID: 命名空间/任务名-once-事件标识, 各worker相同, 多次立即执行互不相同
+func BuildOnceRunId(job *Job, onceId string) string {
+	return BuildJobFullName(job.Namespace, job.Name) + "-once-" + onceId
+}
+
+//根据执行结果得出日志的执行状态
+func BuildJobStatus(result *JobExecuteResult) string {
+	switch {
+	case result.Err == nil:
+		return JOB_STATUS_SUCCESS
+	case result.Err == ERR_LOCK_ALREADY_REQUIRED:
+		return JOB_STATUS_LOCK_CONFLICT
+	case result.IsOOM:
+		return JOB_STATUS_OOM
+	case result.IsTimeout:
+		return JOB_STATUS_TIMEOUT
+	case result.IsKilled: //只有被强杀、替换或worker退出才算, 任务自己因信号退出算失败
+		return JOB_STATUS_KILLED
+	}
+	return JOB_STATUS_FAILED
+}
+
+//强杀时SIGTERM到SIGKILL之间的等待时间
+func BuildKillGracePeriod(job *Job) time.Duration {
+	if job.KillGracePeriod <= 0 {
+		return JOB_KILL_GRACE_PERIOD * time.Second
+	}
+	return time.Duration(job.KillGracePeriod) * time.Second
+}
+
+//计算下次重试的等待时间, 不需要重试时retry为false
+func BuildRetryDelay(job *Job, result *JobExecuteResult) (delay time.Duration, retry bool) {
+	var (
+		policy   *RetryPolicy
+		exitCode int
+		i        int
+	)
+
+	policy = &job.Retry
+
+	//执行成功, 或已达最大尝试次数
+	if result.Err == nil || result.Attempt >= policy.MaxAttempts {
+		return
+	}
+
+	//被强杀、超时或被worker拒绝的任务不重试
+	if result.ExecuteInfo.CancelCtx.Err() != nil || result.IsTimeout || result.IsRejected {
+		return
+	}
+
+	//判断退出码是否可重试
+	if len(policy.RetryableExitCodes) != 0 {
+		for _, exitCode = range policy.RetryableExitCodes {
+			if exitCode == result.ExitCode {
+				retry = true
+				break
+			}
+		}
+		if !retry {
+			return
+		}
+	}
+	retry = true
+
+	//指数退避: initialDelay * backoffFactor^(attempt-1)
+	delay = time.Duration(policy.InitialDelay) * time.Second
+	if policy.BackoffFactor > 0 {
+		for i = 1; i < result.Attempt; i++ {
+			delay = time.Duration(float64(delay) * policy.BackoffFactor)
+		}
+	}
+	return
+}
+
+//判断worker是否可以执行该任务: 在允许的worker列表中, 且标签满足选择器
+func MatchWorker(job *Job, workerIP string, labels map[string]string) bool {
+	var (
+		workerId string
+		matched  bool
+		key      string
+		value    string
+	)
+
+	if len(job.WorkerIds) != 0 {
+		for _, workerId = range job.WorkerIds {
+			if workerId == workerIP {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for key, value = range job.NodeSelector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
 //提取worker的IP
 func ExtractWorkerIP(regKey string) string {
 	return strings.TrimPrefix(regKey, JOB_WORKER_DIR)
@@ -207,8 +1149,13 @@ func StrSliceRemoveRepeat(slice []string) (newSlice []string) {
 
 //字符串->时间对象
 func Str2Time(formatTimeStr string) time.Time {
-	timeLayout := "2006-01-02 15:04:05"
 	loc, _ := time.LoadLocation("Local")
+	return Str2TimeInLocation(formatTimeStr, loc)
+}
+
+//按指定时区解析时间字符串
+func Str2TimeInLocation(formatTimeStr string, loc *time.Location) time.Time {
+	timeLayout := "2006-01-02 15:04:05"
 	theTime, _ := time.ParseInLocation(timeLayout, formatTimeStr, loc) //使用模板在对应时区转化为time.time类型
 
 	return theTime
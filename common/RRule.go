@@ -0,0 +1,425 @@
+package common
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RFC 5545 RRULE中的频率
+const (
+	RRULE_FREQ_DAILY   = "DAILY"
+	RRULE_FREQ_WEEKLY  = "WEEKLY"
+	RRULE_FREQ_MONTHLY = "MONTHLY"
+	RRULE_FREQ_YEARLY  = "YEARLY"
+
+	//查找下次触发时最多检查的周期数, 避免规则永远不会命中时死循环
+	RRULE_MAX_PERIODS = 10000
+)
+
+var (
+	rruleWeekdays = map[string]time.Weekday{
+		"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+		"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+	}
+)
+
+//BYDAY中的一项, 如MO, 2TU, -1FR
+type rruleDay struct {
+	weekday time.Weekday
+	nth     int //0表示周期内每个该星期几
+}
+
+//解析好的RRULE, 时间都是墙钟时间(UTC表示), 与cron的计算方式一致
+//支持FREQ=DAILY/WEEKLY/MONTHLY/YEARLY, INTERVAL, COUNT, UNTIL, WKST,
+//BYMONTH, BYMONTHDAY, BYDAY, BYHOUR, BYMINUTE, BYSECOND, BYSETPOS
+type RRule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time //时刻, 零值表示不限制
+	wkst       time.Weekday
+	byMonth    []int
+	byMonthDay []int
+	byDay      []rruleDay
+	byHour     []int
+	byMinute   []int
+	bySecond   []int
+	bySetPos   []int
+	dtStart    time.Time //起始墙钟时间
+}
+
+//解析RRULE, 可以带"RRULE:"前缀; dtStart为规则的起始时刻, 未指定的时分秒取自它
+func ParseRRule(rule string, dtStart time.Time, location *time.Location) (rrule *RRule, err error) {
+	var (
+		part  string
+		idx   int
+		name  string
+		value string
+		item  string
+		day   rruleDay
+		ok    bool
+	)
+
+	rrule = &RRule{
+		interval: 1,
+		wkst:     time.Monday,
+		dtStart:  wallClock(dtStart, location),
+	}
+
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	for _, part = range strings.Split(rule, ";") {
+		if part == "" {
+			continue
+		}
+		if idx = strings.Index(part, "="); idx <= 0 {
+			return nil, rruleError("无法解析" + part)
+		}
+		name, value = strings.ToUpper(part[:idx]), strings.ToUpper(part[idx+1:])
+
+		switch name {
+		case "FREQ":
+			switch value {
+			case RRULE_FREQ_DAILY, RRULE_FREQ_WEEKLY, RRULE_FREQ_MONTHLY, RRULE_FREQ_YEARLY:
+				rrule.freq = value
+			default:
+				return nil, rruleError("FREQ只支持DAILY/WEEKLY/MONTHLY/YEARLY")
+			}
+		case "INTERVAL":
+			if rrule.interval, err = strconv.Atoi(value); err != nil || rrule.interval <= 0 {
+				return nil, rruleError("INTERVAL必须是正整数")
+			}
+		case "COUNT":
+			if rrule.count, err = strconv.Atoi(value); err != nil || rrule.count <= 0 {
+				return nil, rruleError("COUNT必须是正整数")
+			}
+		case "UNTIL":
+			if rrule.until, err = parseRRuleUntil(value, location); err != nil {
+				return nil, rruleError("UNTIL格式错误")
+			}
+		case "WKST":
+			if rrule.wkst, ok = rruleWeekdays[value]; !ok {
+				return nil, rruleError("WKST格式错误")
+			}
+		case "BYMONTH":
+			if rrule.byMonth, err = parseRRuleInts(value, 1, 12, false); err != nil {
+				return nil, rruleError("BYMONTH取值范围1~12")
+			}
+		case "BYMONTHDAY":
+			if rrule.byMonthDay, err = parseRRuleInts(value, 1, 31, true); err != nil {
+				return nil, rruleError("BYMONTHDAY取值范围1~31或-31~-1")
+			}
+		case "BYHOUR":
+			if rrule.byHour, err = parseRRuleInts(value, 0, 23, false); err != nil {
+				return nil, rruleError("BYHOUR取值范围0~23")
+			}
+		case "BYMINUTE":
+			if rrule.byMinute, err = parseRRuleInts(value, 0, 59, false); err != nil {
+				return nil, rruleError("BYMINUTE取值范围0~59")
+			}
+		case "BYSECOND":
+			if rrule.bySecond, err = parseRRuleInts(value, 0, 59, false); err != nil {
+				return nil, rruleError("BYSECOND取值范围0~59")
+			}
+		case "BYSETPOS":
+			if rrule.bySetPos, err = parseRRuleInts(value, 1, 366, true); err != nil {
+				return nil, rruleError("BYSETPOS取值范围1~366或-366~-1")
+			}
+		case "BYDAY":
+			for _, item = range strings.Split(value, ",") {
+				if day, err = parseRRuleDay(item); err != nil {
+					return nil, rruleError("BYDAY格式错误: " + item)
+				}
+				rrule.byDay = append(rrule.byDay, day)
+			}
+		default:
+			return nil, rruleError("不支持" + name)
+		}
+	}
+	err = nil
+
+	if rrule.freq == "" {
+		return nil, rruleError("缺少FREQ")
+	}
+	if rrule.count != 0 && !rrule.until.IsZero() {
+		return nil, rruleError("COUNT和UNTIL不能同时使用")
+	}
+
+	//带序号的BYDAY(如2TU)只能用于按月或按年
+	for _, day = range rrule.byDay {
+		if day.nth != 0 && rrule.freq != RRULE_FREQ_MONTHLY && rrule.freq != RRULE_FREQ_YEARLY {
+			return nil, rruleError("带序号的BYDAY只能用于FREQ=MONTHLY/YEARLY")
+		}
+	}
+	return
+}
+
+func rruleError(detail string) error {
+	return errors.New(ERR_RRULE.Error() + ": " + detail)
+}
+
+//解析逗号分隔的整数列表, allowNegative时允许-max~-min
+func parseRRuleInts(value string, min int, max int, allowNegative bool) (ints []int, err error) {
+	var (
+		item string
+		n    int
+	)
+
+	for _, item = range strings.Split(value, ",") {
+		if n, err = strconv.Atoi(item); err != nil {
+			return
+		}
+		if !(n >= min && n <= max) && !(allowNegative && n <= -min && n >= -max) {
+			err = ERR_RRULE
+			return
+		}
+		ints = append(ints, n)
+	}
+	return
+}
+
+//解析BYDAY的一项
+func parseRRuleDay(item string) (day rruleDay, err error) {
+	var (
+		ok bool
+	)
+
+	if len(item) < 2 {
+		err = ERR_RRULE
+		return
+	}
+	if day.weekday, ok = rruleWeekdays[item[len(item)-2:]]; !ok {
+		err = ERR_RRULE
+		return
+	}
+	if item = item[:len(item)-2]; item != "" {
+		if day.nth, err = strconv.Atoi(strings.TrimPrefix(item, "+")); err != nil || day.nth == 0 || day.nth > 53 || day.nth < -53 {
+			err = ERR_RRULE
+		}
+	}
+	return
+}
+
+//UNTIL可以是UTC时间, 本地时间或日期
+func parseRRuleUntil(value string, location *time.Location) (until time.Time, err error) {
+	switch {
+	case len(value) == 8:
+		if until, err = time.ParseInLocation("20060102", value, location); err == nil {
+			until = until.AddDate(0, 0, 1).Add(-time.Second) //包含当天
+		}
+	case strings.HasSuffix(value, "Z"):
+		until, err = time.Parse("20060102T150405Z", value)
+	default:
+		until, err = time.ParseInLocation("20060102T150405", value, location)
+	}
+	return
+}
+
+//周期的起点(墙钟时间)
+func (rrule *RRule) periodStart(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch rrule.freq {
+	case RRULE_FREQ_WEEKLY:
+		return t.AddDate(0, 0, -((int(t.Weekday()) - int(rrule.wkst) + 7) % 7))
+	case RRULE_FREQ_MONTHLY:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case RRULE_FREQ_YEARLY:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+//向后推n个周期
+func (rrule *RRule) periodAdd(period time.Time, n int) time.Time {
+	switch rrule.freq {
+	case RRULE_FREQ_WEEKLY:
+		return period.AddDate(0, 0, 7*n)
+	case RRULE_FREQ_MONTHLY:
+		return period.AddDate(0, n, 0)
+	case RRULE_FREQ_YEARLY:
+		return period.AddDate(n, 0, 0)
+	}
+	return period.AddDate(0, 0, n)
+}
+
+//两个周期起点之间相差的周期数
+func (rrule *RRule) periodDiff(from time.Time, to time.Time) int {
+	switch rrule.freq {
+	case RRULE_FREQ_WEEKLY:
+		return int(to.Sub(from).Hours()/24) / 7
+	case RRULE_FREQ_MONTHLY:
+		return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+	case RRULE_FREQ_YEARLY:
+		return to.Year() - from.Year()
+	}
+	return int(to.Sub(from).Hours() / 24)
+}
+
+//周期内的日期是否满足BYMONTH/BYMONTHDAY/BYDAY
+func (rrule *RRule) matchDay(day time.Time) bool {
+	var (
+		month      int
+		monthDay   int
+		daysInMon  int
+		ok         bool
+		byDay      rruleDay
+		nth        int
+		nthFromEnd int
+	)
+
+	if len(rrule.byMonth) != 0 {
+		for _, month = range rrule.byMonth {
+			if ok = time.Month(month) == day.Month(); ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	daysInMon = time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if len(rrule.byMonthDay) != 0 {
+		ok = false
+		for _, monthDay = range rrule.byMonthDay {
+			if ok = monthDay == day.Day() || (monthDay < 0 && daysInMon+monthDay+1 == day.Day()); ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(rrule.byDay) != 0 {
+		//序号在按年且没有BYMONTH时按全年计算, 否则按月计算
+		if rrule.freq == RRULE_FREQ_YEARLY && len(rrule.byMonth) == 0 {
+			nth = (day.YearDay()-1)/7 + 1
+			nthFromEnd = -((time.Date(day.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay()-day.YearDay())/7 + 1)
+		} else {
+			nth = (day.Day()-1)/7 + 1
+			nthFromEnd = -((daysInMon-day.Day())/7 + 1)
+		}
+		ok = false
+		for _, byDay = range rrule.byDay {
+			if ok = byDay.weekday == day.Weekday() && (byDay.nth == 0 || byDay.nth == nth || byDay.nth == nthFromEnd); ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	//没有指定日期规则时, 按RFC 5545取起始时间对应的日期
+	if len(rrule.byMonthDay) == 0 && len(rrule.byDay) == 0 {
+		switch rrule.freq {
+		case RRULE_FREQ_WEEKLY:
+			return day.Weekday() == rrule.dtStart.Weekday()
+		case RRULE_FREQ_MONTHLY:
+			return day.Day() == rrule.dtStart.Day()
+		case RRULE_FREQ_YEARLY:
+			return day.Day() == rrule.dtStart.Day() && (len(rrule.byMonth) != 0 || day.Month() == rrule.dtStart.Month())
+		}
+	}
+	return true
+}
+
+//列出一个周期内的所有触发时间(墙钟时间), 按先后排列并应用BYSETPOS
+func (rrule *RRule) expandPeriod(period time.Time) (walls []time.Time) {
+	var (
+		end      time.Time
+		day      time.Time
+		hours    []int
+		minutes  []int
+		seconds  []int
+		hour     int
+		minute   int
+		second   int
+		selected []time.Time
+		pos      int
+	)
+
+	end = rrule.periodAdd(period, 1)
+
+	hours, minutes, seconds = rrule.byHour, rrule.byMinute, rrule.bySecond
+	if len(hours) == 0 {
+		hours = []int{rrule.dtStart.Hour()}
+	}
+	if len(minutes) == 0 {
+		minutes = []int{rrule.dtStart.Minute()}
+	}
+	if len(seconds) == 0 {
+		seconds = []int{rrule.dtStart.Second()}
+	}
+
+	for day = period; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if !rrule.matchDay(day) {
+			continue
+		}
+		for _, hour = range hours {
+			for _, minute = range minutes {
+				for _, second = range seconds {
+					walls = append(walls, time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, time.UTC))
+				}
+			}
+		}
+	}
+	sort.Slice(walls, func(i, j int) bool { return walls[i].Before(walls[j]) })
+
+	if len(rrule.bySetPos) == 0 {
+		return
+	}
+	for _, pos = range rrule.bySetPos {
+		if pos > 0 && pos <= len(walls) {
+			selected = append(selected, walls[pos-1])
+		} else if pos < 0 && -pos <= len(walls) {
+			selected = append(selected, walls[len(walls)+pos])
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+	return selected
+}
+
+//计算from之后的下次触发时刻, 没有时返回零值
+func (rrule *RRule) Next(from time.Time, location *time.Location) time.Time {
+	var (
+		startPeriod time.Time
+		period      time.Time
+		skip        int
+		i           int
+		wall        time.Time
+		instant     time.Time
+		occurrences int
+	)
+
+	startPeriod = rrule.periodStart(rrule.dtStart)
+
+	//没有COUNT时直接跳到from所在的周期, 按INTERVAL对齐
+	if rrule.count == 0 {
+		if skip = rrule.periodDiff(startPeriod, rrule.periodStart(wallClock(from, location))); skip > 0 {
+			startPeriod = rrule.periodAdd(startPeriod, skip-skip%rrule.interval)
+		}
+	}
+
+	for i, period = 0, startPeriod; i < RRULE_MAX_PERIODS; i, period = i+1, rrule.periodAdd(period, rrule.interval) {
+		for _, wall = range rrule.expandPeriod(period) {
+			if wall.Before(rrule.dtStart) {
+				continue
+			}
+			if occurrences++; rrule.count != 0 && occurrences > rrule.count {
+				return time.Time{}
+			}
+			instant = wallClockInstant(wall, location)
+			if !rrule.until.IsZero() && instant.After(rrule.until) {
+				return time.Time{}
+			}
+			if instant.After(from) {
+				return instant
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRuleNext(t *testing.T) {
+	var (
+		berlin *time.Location
+		err    error
+	)
+
+	if berlin, err = time.LoadLocation("Europe/Berlin"); err != nil {
+		t.Skip("没有时区数据:", err)
+	}
+
+	cases := []struct {
+		name     string
+		rule     string
+		location *time.Location
+		dtStart  string
+		from     string
+		want     string //任务时区的墙钟时间, 为空表示不再触发
+	}{
+		//BYSETPOS
+		{"每月最后一个工作日", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", time.UTC, "2026-01-01 09:00:00", "2026-01-15 00:00:00", "2026-01-30 09:00:00"},
+		{"每月最后一个工作日-跨月", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", time.UTC, "2026-01-01 09:00:00", "2026-01-30 09:00:00", "2026-02-27 09:00:00"},
+		{"每月第一个工作日", "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1", time.UTC, "2026-01-01 09:00:00", "2026-01-30 10:00:00", "2026-02-02 09:00:00"},
+
+		//带序号的BYDAY
+		{"每月第二个周二", "FREQ=MONTHLY;BYDAY=2TU", time.UTC, "2026-01-01 09:00:00", "2026-01-01 00:00:00", "2026-01-13 09:00:00"},
+		{"每月第二个周二-下个月", "FREQ=MONTHLY;BYDAY=2TU", time.UTC, "2026-01-01 09:00:00", "2026-01-13 09:00:00", "2026-02-10 09:00:00"},
+		{"每月最后一个周五", "FREQ=MONTHLY;BYDAY=-1FR", time.UTC, "2026-01-01 09:00:00", "2026-05-01 00:00:00", "2026-05-29 09:00:00"},
+		{"每年5月最后一个周一", "FREQ=YEARLY;BYMONTH=5;BYDAY=-1MO", time.UTC, "2026-01-01 09:00:00", "2026-01-01 00:00:00", "2026-05-25 09:00:00"},
+
+		//INTERVAL从开始时间对齐
+		{"隔周周一", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", time.UTC, "2026-01-05 10:00:00", "2026-03-03 00:00:00", "2026-03-16 10:00:00"},
+		{"隔周周一-当天", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", time.UTC, "2026-01-05 10:00:00", "2026-03-02 09:00:00", "2026-03-02 10:00:00"},
+		{"每3天", "FREQ=DAILY;INTERVAL=3", time.UTC, "2026-01-01 08:00:00", "2026-01-05 00:00:00", "2026-01-07 08:00:00"},
+		{"隔月15号", "FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=15", time.UTC, "2026-01-01 06:00:00", "2026-02-01 00:00:00", "2026-03-15 06:00:00"},
+
+		//COUNT从开始时间数起
+		{"COUNT未用完", "FREQ=DAILY;COUNT=3", time.UTC, "2026-01-01 08:00:00", "2026-01-02 08:00:00", "2026-01-03 08:00:00"},
+		{"COUNT用完", "FREQ=DAILY;COUNT=3", time.UTC, "2026-01-01 08:00:00", "2026-01-03 08:00:00", ""},
+
+		//夏令时: 跳过的墙钟时间取跳变的时刻, 重复的墙钟时间取第一次
+		{"夏令时开始", "FREQ=DAILY;BYHOUR=2;BYMINUTE=30", berlin, "2026-03-01 00:00:00", "2026-03-28 12:00:00", "2026-03-29 03:00:00"},
+		{"夏令时开始-墙钟时间不变", "FREQ=DAILY;BYHOUR=9", berlin, "2026-03-01 00:00:00", "2026-03-28 10:00:00", "2026-03-29 09:00:00"},
+	}
+
+	for _, c := range cases {
+		rrule, err := ParseRRule(c.rule, Str2TimeInLocation(c.dtStart, c.location), c.location)
+		if err != nil {
+			t.Errorf("%s: 解析失败: %v", c.name, err)
+			continue
+		}
+		next := rrule.Next(Str2TimeInLocation(c.from, c.location), c.location)
+		if c.want == "" {
+			if !next.IsZero() {
+				t.Errorf("%s: 期望不再触发, 得到%v", c.name, next)
+			}
+			continue
+		}
+		if want := Str2TimeInLocation(c.want, c.location); !next.Equal(want) {
+			t.Errorf("%s: 期望%v, 得到%v", c.name, want, next)
+		}
+	}
+
+	//夏令时结束时取第一次出现的02:30(夏令时)
+	rrule, _ := ParseRRule("FREQ=DAILY;BYHOUR=2;BYMINUTE=30", Str2TimeInLocation("2026-10-01 00:00:00", berlin), berlin)
+	if next := rrule.Next(Str2TimeInLocation("2026-10-24 12:00:00", berlin), berlin); !next.Equal(time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC)) {
+		t.Errorf("夏令时结束: 期望2026-10-25 00:30 UTC, 得到%v", next.UTC())
+	}
+}
+
+func TestVerifyJobRRules(t *testing.T) {
+	cases := []struct {
+		name      string
+		rule      string
+		startTime string
+		ok        bool
+	}{
+		{"没有开始时间", "FREQ=DAILY", "", true},
+		{"COUNT没有开始时间", "FREQ=DAILY;COUNT=3", "", false},
+		{"COUNT有开始时间", "FREQ=DAILY;COUNT=3", time.Now().Format("2006-01-02 15:04:05"), true},
+		{"COUNT已用完", "FREQ=DAILY;COUNT=3", "2020-01-01 00:00:00", false},
+		{"UNTIL已过", "FREQ=DAILY;UNTIL=20200101", "", false},
+		{"永远不会触发", "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30", "", false},
+	}
+
+	for _, c := range cases {
+		job := &Job{Name: "t", ScheduleType: SCHEDULE_TYPE_RRULE, RRule: c.rule, StartTime: c.startTime}
+		if err := VerifyJobRRules(job); (err == nil) != c.ok {
+			t.Errorf("%s: 期望ok=%v, 得到%v", c.name, c.ok, err)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package common
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+)
+
+var (
+	//H, H(a-b), H/n, H(a-b)/n
+	cronHashRegexp = regexp.MustCompile(`^H(?:\((\d+)-(\d+)\))?(?:/(\d+))?$`)
+)
+
+//cron各字段H的取值范围, 日期只取1-28, 保证每个月都能触发
+var (
+	cronHashRanges5 = [][2]int{{0, 59}, {0, 23}, {1, 28}, {1, 12}, {0, 6}}
+	cronHashRanges6 = [][2]int{{0, 59}, {0, 23}, {1, 28}, {1, 12}, {0, 6}, {1970, 2099}}
+	cronHashRanges7 = [][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 28}, {1, 12}, {0, 6}, {1970, 2099}}
+)
+
+//把cron表达式中的H替换成由seed(任务名)决定的固定值, 同一个任务每次解析结果相同, 不同任务分散开
+//H: 范围内取一个值; H(a-b): a-b内取一个值; H/n, H(a-b)/n: 从范围内一个值开始每n个单位触发一次
+func ResolveCronHash(cronExpr string, seed string) (resolved string, err error) {
+	var (
+		fields  []string
+		ranges  [][2]int
+		i       int
+		items   []string
+		j       int
+		matches []string
+		lo      int
+		hi      int
+		step    int
+		value   uint32
+		hasher  hash.Hash32
+	)
+
+	fields = strings.Fields(cronExpr)
+	if !strings.Contains(cronExpr, "H") || len(fields) == 0 || strings.HasPrefix(fields[0], "@") {
+		return cronExpr, nil
+	}
+
+	hasher = fnv.New32a()
+	switch len(fields) {
+	case 5:
+		ranges = cronHashRanges5
+	case 6:
+		ranges = cronHashRanges6
+	case 7:
+		ranges = cronHashRanges7
+	default:
+		err = ERR_CRON_HASH
+		return
+	}
+
+	for i = range fields {
+		items = strings.Split(fields[i], ",")
+		for j = range items {
+			if !strings.HasPrefix(items[j], "H") {
+				continue
+			}
+			if matches = cronHashRegexp.FindStringSubmatch(items[j]); matches == nil {
+				err = ERR_CRON_HASH
+				return
+			}
+
+			//每个字段用不同的hash, 避免分钟和小时取到相关的值
+			hasher.Reset()
+			hasher.Write([]byte(seed + "/" + strconv.Itoa(i)))
+			value = hasher.Sum32()
+
+			lo, hi = ranges[i][0], ranges[i][1]
+			if matches[1] != "" {
+				lo, _ = strconv.Atoi(matches[1])
+				hi, _ = strconv.Atoi(matches[2])
+				if lo < ranges[i][0] || hi > ranges[i][1] || lo > hi {
+					err = ERR_CRON_HASH
+					return
+				}
+			}
+
+			if matches[3] == "" {
+				items[j] = strconv.Itoa(lo + int(value%uint32(hi-lo+1)))
+				continue
+			}
+			if step, _ = strconv.Atoi(matches[3]); step <= 0 || step > hi-lo+1 {
+				err = ERR_CRON_HASH
+				return
+			}
+			items[j] = fmt.Sprintf("%d-%d/%d", lo+int(value%uint32(step)), hi, step)
+		}
+		fields[i] = strings.Join(items, ",")
+	}
+
+	resolved = strings.Join(fields, " ")
+	return
+}
+
+//任务的时区, 未配置时使用worker本地时区
+func BuildJobLocation(job *Job) (location *time.Location, err error) {
+	if job.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(job.Timezone)
+}
+
+//把时刻转成时区内的墙钟时间, 用UTC表示, 这样cron表达式的计算不受夏令时跳变影响
+func wallClock(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+//把墙钟时间换算回时刻
+//夏令时重叠(墙钟时间出现两次): 取第一次出现的时刻
+//夏令时跳过(墙钟时间不存在): 取跳变的时刻, 保证不会漏掉
+func wallClockInstant(wall time.Time, location *time.Location) (instant time.Time) {
+	var (
+		offsetBefore int
+		offsetAfter  int
+		candidate    time.Time
+		offset       int
+		lo           time.Time
+		hi           time.Time
+		mid          time.Time
+	)
+
+	//前后一天的偏移量, 两者不同说明附近有跳变
+	_, offsetBefore = wall.Add(-24 * time.Hour).In(location).Zone()
+	_, offsetAfter = wall.Add(24 * time.Hour).In(location).Zone()
+
+	for _, offset = range []int{offsetBefore, offsetAfter} {
+		candidate = wall.Add(-time.Duration(offset) * time.Second).In(location)
+		if wallClock(candidate, location).Equal(wall) && (instant.IsZero() || candidate.Before(instant)) {
+			instant = candidate
+		}
+	}
+	if !instant.IsZero() {
+		return
+	}
+
+	//墙钟时间落在跳过的区间里, 二分查找跳变时刻
+	lo = wall.Add(-time.Duration(offsetAfter) * time.Second)
+	hi = wall.Add(-time.Duration(offsetBefore) * time.Second)
+	if hi.Before(lo) {
+		lo, hi = hi, lo
+	}
+	for hi.Sub(lo) > time.Second {
+		mid = lo.Add(hi.Sub(lo) / 2)
+		if _, offset = mid.In(location).Zone(); offset == offsetBefore {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi.In(location)
+}
+
+//任务的所有调度, 任务自身的调度字段是第一个, 名为default
+//任务自身是cron类型且没有填表达式, 同时配置了额外调度时, 只用额外调度
+func BuildJobSchedules(job *Job) (schedules []JobSchedule) {
+	var (
+		i int
+	)
+
+	if job.CronExpr != "" || (job.ScheduleType != "" && job.ScheduleType != SCHEDULE_TYPE_CRON) || len(job.Schedules) == 0 {
+		schedules = append(schedules, JobSchedule{
+			Name:         SCHEDULE_DEFAULT_NAME,
+			ScheduleType: job.ScheduleType,
+			CronExpr:     job.CronExpr,
+			Interval:     job.Interval,
+			RunAt:        job.RunAt,
+			RRule:        job.RRule,
+		})
+	}
+
+	//未命名的额外调度按序号命名
+	for i = range job.Schedules {
+		schedules = append(schedules, job.Schedules[i])
+		if schedules[len(schedules)-1].Name == "" {
+			schedules[len(schedules)-1].Name = "schedule-" + strconv.Itoa(i+1)
+		}
+	}
+	return
+}
+
+//调度实际使用的cron表达式, H按命名空间/任务名替换, 额外调度再加上调度名, 非cron类型返回空
+func buildResolvedCronExpr(job *Job, schedule *JobSchedule) (cronExpr string, err error) {
+	var (
+		seed string
+	)
+
+	if schedule.ScheduleType != "" && schedule.ScheduleType != SCHEDULE_TYPE_CRON {
+		return
+	}
+	seed = BuildJobFullName(job.Namespace, job.Name)
+	if schedule.Name != SCHEDULE_DEFAULT_NAME {
+		seed = seed + "#" + schedule.Name
+	}
+	return ResolveCronHash(schedule.CronExpr, seed)
+}
+
+//填充任务及其额外调度H替换后的cron表达式, 用于接口展示
+func FillResolvedCronExpr(job *Job) {
+	var (
+		schedules []JobSchedule
+		offset    int
+		i         int
+	)
+
+	//额外调度排在任务自身的调度之后
+	schedules = BuildJobSchedules(job)
+	offset = len(schedules) - len(job.Schedules)
+
+	job.ResolvedCronExpr = ""
+	if offset == 1 {
+		job.ResolvedCronExpr, _ = buildResolvedCronExpr(job, &schedules[0])
+	}
+	for i = range job.Schedules {
+		job.Schedules[i].ResolvedCronExpr, _ = buildResolvedCronExpr(job, &schedules[offset+i])
+	}
+}
+
+//解析一个调度
+func buildJobScheduleEntry(job *Job, schedule *JobSchedule, location *time.Location) (entry *JobScheduleEntry, err error) {
+	var (
+		cronExpr string
+	)
+
+	entry = &JobScheduleEntry{
+		Name:         schedule.Name,
+		ScheduleType: schedule.ScheduleType,
+	}
+	if entry.ScheduleType == "" {
+		entry.ScheduleType = SCHEDULE_TYPE_CRON
+	}
+
+	switch entry.ScheduleType {
+	case SCHEDULE_TYPE_CRON: //解析cron表达式, H按任务名替换成固定值
+		if cronExpr, err = buildResolvedCronExpr(job, schedule); err != nil {
+			return
+		}
+		if entry.Expr, err = cronexpr.Parse(cronExpr); err != nil {
+			return
+		}
+	case SCHEDULE_TYPE_EVERY: //间隔从开始时间起算, 没有开始时间时从1970-01-01起算, 保证各worker算出的计划时间一致
+		if entry.Interval, err = time.ParseDuration(schedule.Interval); err != nil || entry.Interval <= 0 {
+			err = ERR_SCHEDULE_INTERVAL
+			return
+		}
+		entry.Anchor = time.Unix(0, 0)
+		if job.StartTime != "" {
+			entry.Anchor = Str2TimeInLocation(job.StartTime, location)
+		}
+	case SCHEDULE_TYPE_AT:
+		if entry.RunAt = Str2TimeInLocation(schedule.RunAt, location); entry.RunAt.IsZero() {
+			err = ERR_SCHEDULE_RUN_AT
+			return
+		}
+	case SCHEDULE_TYPE_RRULE: //规则从开始时间起算, 没有开始时间时从1970-01-01起算
+		if entry.RRule, err = ParseRRule(schedule.RRule, buildJobDtStart(job, location), location); err != nil {
+			return
+		}
+	default:
+		err = ERR_SCHEDULE_TYPE
+	}
+	return
+}
+
+//RRULE的起始时刻
+func buildJobDtStart(job *Job, location *time.Location) time.Time {
+	if job.StartTime != "" {
+		return Str2TimeInLocation(job.StartTime, location)
+	}
+	return time.Date(1970, 1, 1, 0, 0, 0, 0, location)
+}
+
+//校验任务中所有rrule类型的调度: COUNT从开始时间起数, 必须设置开始时间; 当前时间之后必须还会触发
+func VerifyJobRRules(job *Job) (err error) {
+	var (
+		schedules []JobSchedule
+		location  *time.Location
+		i         int
+		rrule     *RRule
+	)
+
+	if location, err = BuildJobLocation(job); err != nil {
+		return
+	}
+	schedules = BuildJobSchedules(job)
+	for i = range schedules {
+		if schedules[i].ScheduleType != SCHEDULE_TYPE_RRULE {
+			continue
+		}
+		if rrule, err = ParseRRule(schedules[i].RRule, buildJobDtStart(job, location), location); err != nil {
+			return
+		}
+		if rrule.count != 0 && job.StartTime == "" {
+			return rruleError("使用COUNT时必须设置开始时间")
+		}
+		if rrule.Next(time.Now(), location).IsZero() {
+			return rruleError("当前时间之后不会再触发")
+		}
+	}
+	return
+}
+
+//解析任务的所有调度
+func buildJobScheduleEntries(job *Job, location *time.Location) (entries []*JobScheduleEntry, err error) {
+	var (
+		schedules []JobSchedule
+		names     map[string]bool
+		i         int
+		entry     *JobScheduleEntry
+	)
+
+	names = make(map[string]bool)
+	schedules = BuildJobSchedules(job)
+	for i = range schedules {
+		if names[schedules[i].Name] {
+			err = ERR_SCHEDULE_NAME
+			return
+		}
+		names[schedules[i].Name] = true
+
+		if entry, err = buildJobScheduleEntry(job, &schedules[i], location); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+//所有调度都是at类型, 全部执行完后任务即完成
+func IsOneShotJob(job *Job) bool {
+	var (
+		schedules []JobSchedule
+		i         int
+	)
+
+	schedules = BuildJobSchedules(job)
+	for i = range schedules {
+		if schedules[i].ScheduleType != SCHEDULE_TYPE_AT {
+			return false
+		}
+	}
+	return len(schedules) != 0
+}
+
+//取所有调度中最早的下次触发时刻, 不考虑日历
+func nextScheduleTime(jobSchedulePlan *JobSchedulePlan, from time.Time) (next time.Time) {
+	var (
+		entry     *JobScheduleEntry
+		entryNext time.Time
+	)
+
+	for _, entry = range jobSchedulePlan.Schedules {
+		if entryNext = nextEntryTime(jobSchedulePlan, entry, from); !entryNext.IsZero() && (next.IsZero() || entryNext.Before(next)) {
+			next = entryNext
+		}
+	}
+	return
+}
+
+//找出在planTime触发的调度名, 多个调度同时触发时取排在前面的
+func BuildScheduleName(jobSchedulePlan *JobSchedulePlan, planTime time.Time) string {
+	var (
+		entry *JobScheduleEntry
+	)
+
+	for _, entry = range jobSchedulePlan.Schedules {
+		if nextEntryTime(jobSchedulePlan, entry, planTime.Add(-time.Nanosecond)).Equal(planTime) {
+			return entry.Name
+		}
+	}
+	return ""
+}
+
+//计算一个调度在from之后的下次触发时刻
+func nextEntryTime(jobSchedulePlan *JobSchedulePlan, entry *JobScheduleEntry, from time.Time) (next time.Time) {
+	var (
+		ticks int64
+	)
+
+	switch entry.ScheduleType {
+	case SCHEDULE_TYPE_CRON:
+		return nextCronTime(entry.Expr, jobSchedulePlan.Location, from)
+	case SCHEDULE_TYPE_EVERY: //起算时间之后第一个晚于from的间隔点
+		if from.Before(entry.Anchor) {
+			return entry.Anchor.In(jobSchedulePlan.Location)
+		}
+		ticks = int64(from.Sub(entry.Anchor)/entry.Interval) + 1
+		return entry.Anchor.Add(time.Duration(ticks) * entry.Interval).In(jobSchedulePlan.Location)
+	case SCHEDULE_TYPE_RRULE:
+		return entry.RRule.Next(from, jobSchedulePlan.Location)
+	case SCHEDULE_TYPE_AT: //只执行一次, 执行成功后不再调度
+		if jobSchedulePlan.Job.Completed || !entry.RunAt.After(from) {
+			return time.Time{}
+		}
+		return entry.RunAt
+	}
+	return time.Time{}
+}
+
+//按任务时区计算from之后cron表达式的下次触发时刻, 每个墙钟时间最多触发一次
+func nextCronTime(expr *cronexpr.Expression, location *time.Location, from time.Time) (next time.Time) {
+	var (
+		wall time.Time
+	)
+
+	if location == nil {
+		location = time.Local
+	}
+
+	//在墙钟时间上迭代, 换算回的时刻不晚于from时继续向后找
+	//(重叠区间第二次出现的时刻, 以及跳变后已经触发过的时刻)
+	for wall = wallClock(from, location); ; {
+		if wall = expr.Next(wall); wall.IsZero() {
+			return time.Time{}
+		}
+		if next = wallClockInstant(wall, location); next.After(from) {
+			return
+		}
+	}
+}
+
+//下一天的零点前一刻, 用于跳过被日历排除的整天
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Nanosecond)
+}
+
+//计算from之后的下次调度时间, 跳过被日历排除的日期, 没有下次调度时返回零值
+func BuildNextTime(jobSchedulePlan *JobSchedulePlan, from time.Time) (next time.Time) {
+	var (
+		skipDays    int
+		skipWindows int
+		ok          bool
+		open        time.Time
+	)
+
+	for skipDays < SCHEDULE_MAX_SKIP_DAYS && skipWindows < SCHEDULE_MAX_WINDOW_SKIPS {
+		if next = nextScheduleTime(jobSchedulePlan, from); next.IsZero() {
+			return
+		}
+		//整天被排除, 直接跳到第二天
+		if ok, _ = CheckCalendars(jobSchedulePlan.Job, next, jobSchedulePlan.Calendars); !ok {
+			from = endOfDay(next)
+			skipDays++
+			continue
+		}
+		//不在时间窗口内, 直接跳到窗口重新满足的时刻
+		if ok, _ = CheckTimeWindows(jobSchedulePlan, next); !ok {
+			if open = NextTimeWindowOpen(jobSchedulePlan, next); open.IsZero() {
+				return time.Time{}
+			}
+			from = open.Add(-time.Nanosecond)
+			skipWindows++
+			continue
+		}
+		return
+	}
+	return time.Time{}
+}
+
+//判断t是否在任务的开始/停止时间之内, 开始/停止时间按任务时区解析
+func CheckJobWindow(jobSchedulePlan *JobSchedulePlan, t time.Time) (ok bool, reason string) {
+	var (
+		startTime time.Time
+		stopTime  time.Time
+	)
+
+	startTime = Str2TimeInLocation(jobSchedulePlan.Job.StartTime, jobSchedulePlan.Location)
+	stopTime = Str2TimeInLocation(jobSchedulePlan.Job.StopTime, jobSchedulePlan.Location)
+
+	//开始时间在停止时间之后, 永远不会执行
+	if !startTime.IsZero() && !stopTime.IsZero() && startTime.After(stopTime) {
+		return false, "开始时间在停止时间之后"
+	}
+	//已到停止时间（停止时间在t之前）
+	if !stopTime.IsZero() && stopTime.Before(t) {
+		return false, "已过停止时间"
+	}
+	//未到开始时间（开始时间在t之后）
+	if !startTime.IsZero() && startTime.After(t) {
+		return false, "未到开始时间"
+	}
+	return true, ""
+}
+
+//预览from之后的n次调度, 与worker使用同一套计算:
+//未到开始时间的从开始时间算起, 过了停止时间的不再列出, 不在时间窗口内的不列出;
+//被日历排除的日期每天记一条跳过记录; 暂停的任务每次调度都记为跳过
+func BuildJobPreview(jobSchedulePlan *JobSchedulePlan, from time.Time, n int) (previewTimes []JobPreviewTime) {
+	var (
+		next        time.Time
+		startTime   time.Time
+		skipDays    int
+		skipWindows int
+		ok          bool
+		reason      string
+		runs        int
+		open        time.Time
+	)
+
+	previewTimes = make([]JobPreviewTime, 0)
+
+	//开始时间之前不会调度
+	startTime = Str2TimeInLocation(jobSchedulePlan.Job.StartTime, jobSchedulePlan.Location)
+	if !startTime.IsZero() && startTime.After(from) {
+		from = startTime.Add(-time.Nanosecond)
+	}
+
+	for runs < n && skipDays < SCHEDULE_MAX_SKIP_DAYS && skipWindows < SCHEDULE_MAX_WINDOW_SKIPS {
+		if next = nextScheduleTime(jobSchedulePlan, from); next.IsZero() {
+			return
+		}
+		if ok, _ = CheckJobWindow(jobSchedulePlan, next); !ok {
+			return
+		}
+		if ok, reason = CheckCalendars(jobSchedulePlan.Job, next, jobSchedulePlan.Calendars); !ok {
+			previewTimes = append(previewTimes, JobPreviewTime{Time: next.Format("2006-01-02 15:04:05"), Skipped: true, Reason: reason})
+			from = endOfDay(next)
+			skipDays++
+			continue
+		}
+		//不在时间窗口内的调度不会发生, 不列出
+		if ok, _ = CheckTimeWindows(jobSchedulePlan, next); !ok {
+			if open = NextTimeWindowOpen(jobSchedulePlan, next); open.IsZero() {
+				return
+			}
+			from = open.Add(-time.Nanosecond)
+			skipWindows++
+			continue
+		}
+		if jobSchedulePlan.Job.Paused {
+			previewTimes = append(previewTimes, JobPreviewTime{Time: next.Format("2006-01-02 15:04:05"), Skipped: true, Reason: "任务已暂停"})
+		} else {
+			previewTimes = append(previewTimes, JobPreviewTime{Time: next.Format("2006-01-02 15:04:05")})
+		}
+		runs++
+		from = next
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	//星期的缩写, 按time.Weekday排列
+	weekdayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+//解析星期缩写
+func parseWeekday(name string) (weekday time.Weekday, err error) {
+	var (
+		i int
+	)
+
+	for i = range weekdayNames {
+		if weekdayNames[i] == strings.ToUpper(strings.TrimSpace(name)) {
+			return time.Weekday(i), nil
+		}
+	}
+	err = ERR_TIME_WINDOW
+	return
+}
+
+//解析星期列表, 如MON-FRI, SAT,SUN, FRI-MON
+func parseWindowDays(days string) (result [7]bool, err error) {
+	var (
+		item  string
+		parts []string
+		from  time.Weekday
+		to    time.Weekday
+		i     int
+	)
+
+	if strings.TrimSpace(days) == "" {
+		for i = range result {
+			result[i] = true
+		}
+		return
+	}
+
+	for _, item = range strings.Split(days, ",") {
+		parts = strings.Split(item, "-")
+		if from, err = parseWeekday(parts[0]); err != nil {
+			return
+		}
+		to = from
+		if len(parts) == 2 {
+			if to, err = parseWeekday(parts[1]); err != nil {
+				return
+			}
+		} else if len(parts) > 2 {
+			err = ERR_TIME_WINDOW
+			return
+		}
+		//可以跨周, 如FRI-MON
+		for i = int(from); ; i = (i + 1) % 7 {
+			result[i] = true
+			if i == int(to) {
+				break
+			}
+		}
+	}
+	return
+}
+
+//解析15:04格式的时间为当天的分钟数, 允许24:00
+func parseWindowClock(clock string) (minutes int, err error) {
+	var (
+		parts  []string
+		hour   int
+		minute int
+	)
+
+	if parts = strings.Split(strings.TrimSpace(clock), ":"); len(parts) != 2 {
+		err = ERR_TIME_WINDOW
+		return
+	}
+	if hour, err = strconv.Atoi(parts[0]); err != nil {
+		err = ERR_TIME_WINDOW
+		return
+	}
+	if minute, err = strconv.Atoi(parts[1]); err != nil {
+		err = ERR_TIME_WINDOW
+		return
+	}
+	if minutes = hour*60 + minute; hour < 0 || minute < 0 || minute > 59 || minutes > 24*60 {
+		err = ERR_TIME_WINDOW
+	}
+	return
+}
+
+//解析任务的时间窗口
+func ParseTimeWindows(timeWindows []TimeWindow) (windows []*JobTimeWindow, err error) {
+	var (
+		timeWindow TimeWindow
+		window     *JobTimeWindow
+	)
+
+	for _, timeWindow = range timeWindows {
+		window = &JobTimeWindow{Type: timeWindow.Type}
+		if window.Type != TIME_WINDOW_ALLOW && window.Type != TIME_WINDOW_BLOCK {
+			err = ERR_TIME_WINDOW
+			return
+		}
+		if window.Days, err = parseWindowDays(timeWindow.Days); err != nil {
+			return
+		}
+		if window.Start, err = parseWindowClock(timeWindow.Start); err != nil {
+			return
+		}
+		if window.End, err = parseWindowClock(timeWindow.End); err != nil {
+			return
+		}
+		windows = append(windows, window)
+	}
+	return
+}
+
+//t(已转到任务时区)是否落在窗口内
+func (window *JobTimeWindow) contains(t time.Time) bool {
+	var (
+		minutes int
+	)
+
+	minutes = t.Hour()*60 + t.Minute()
+
+	//当天内的窗口
+	if window.Start < window.End {
+		return window.Days[t.Weekday()] && minutes >= window.Start && minutes < window.End
+	}
+
+	//跨零点(或全天)的窗口: 开始之后算当天, 结束之前算前一天
+	if minutes >= window.Start {
+		return window.Days[t.Weekday()]
+	}
+	if minutes < window.End {
+		return window.Days[(t.Weekday()+6)%7]
+	}
+	return false
+}
+
+//判断t是否满足任务的时间窗口: 在任意一个block窗口内不执行; 配置了allow窗口时必须在其中一个内
+func CheckTimeWindows(jobSchedulePlan *JobSchedulePlan, t time.Time) (ok bool, reason string) {
+	var (
+		window   *JobTimeWindow
+		hasAllow bool
+		allowed  bool
+	)
+
+	if len(jobSchedulePlan.TimeWindows) == 0 {
+		return true, ""
+	}
+
+	t = t.In(jobSchedulePlan.Location)
+	for _, window = range jobSchedulePlan.TimeWindows {
+		switch window.Type {
+		case TIME_WINDOW_BLOCK:
+			if window.contains(t) {
+				return false, "在禁止执行的时间窗口内"
+			}
+		case TIME_WINDOW_ALLOW:
+			hasAllow = true
+			allowed = allowed || window.contains(t)
+		}
+	}
+	if hasAllow && !allowed {
+		return false, "不在允许执行的时间窗口内"
+	}
+	return true, ""
+}
+
+//t不满足时间窗口时, 找t之后第一个满足的时刻, 用于直接跳过整段被挡住的时间, 不再逐个调度点尝试
+//满足与否只会在某个窗口的开始/结束处变化, 窗口按周重复, 最多看8天; 永远不满足时返回零值
+func NextTimeWindowOpen(jobSchedulePlan *JobSchedulePlan, t time.Time) (open time.Time) {
+	var (
+		wallDay   time.Time
+		window    *JobTimeWindow
+		minutes   int
+		candidate time.Time
+		ok        bool
+		day       int
+	)
+
+	wallDay = wallClock(t, jobSchedulePlan.Location)
+	wallDay = time.Date(wallDay.Year(), wallDay.Month(), wallDay.Day(), 0, 0, 0, 0, time.UTC)
+
+	for day = 0; day <= 8; day++ {
+		for _, window = range jobSchedulePlan.TimeWindows {
+			for _, minutes = range []int{window.Start, window.End} {
+				candidate = wallClockInstant(wallDay.AddDate(0, 0, day).Add(time.Duration(minutes)*time.Minute), jobSchedulePlan.Location)
+				if !candidate.After(t) || (!open.IsZero() && !candidate.Before(open)) {
+					continue
+				}
+				if ok, _ = CheckTimeWindows(jobSchedulePlan, candidate); ok {
+					open = candidate
+				}
+			}
+		}
+		//当天的边界都不晚于第二天的边界, 找到即可返回
+		if !open.IsZero() {
+			return
+		}
+	}
+	return
+}
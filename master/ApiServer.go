@@ -10,8 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gorhill/cronexpr"
-
 	"github.com/gyyn/crontab/common"
 )
 
@@ -25,6 +23,14 @@ var (
 	G_apiServer *ApiServer
 )
 
+//操作人, 没有传user时记录请求来源地址
+func buildAuthor(req *http.Request) (author string) {
+	if author = req.Form.Get("user"); author == "" {
+		author = req.RemoteAddr
+	}
+	return
+}
+
 //判断任务配置参数是否合规
 func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -34,6 +40,7 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 		bytes     []byte
 		startTime time.Time
 		stopTime  time.Time
+		location  *time.Location
 		errno     int
 	)
 
@@ -53,11 +60,18 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	//判断job的name
-	if job.Name == "" {
+	if !common.VerifyJobName(job.Name) {
 		errno = -2
 		err = errors.New("NameErr")
 		goto ERR
 	}
+
+	//判断job的命名空间, 为空表示default
+	if job.Namespace != "" && !common.VerifyJobName(job.Namespace) {
+		errno = -15
+		err = errors.New("NamespaceErr")
+		goto ERR
+	}
 	//判断job的shell
 	if job.Command == "" {
 		errno = -3
@@ -65,8 +79,49 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	//判断job的cron表达式
-	if _, err = cronexpr.Parse(job.CronExpr); err != nil {
+	//判断job的时区, 为空表示worker本地时区
+	if location, err = common.BuildJobLocation(&job); err != nil {
+		errno = -17
+		err = errors.New("TimezoneErr")
+		goto ERR
+	}
+
+	//判断job的运行用户/组, 用户是否允许由worker校验
+	if job.RunAsGroup != "" && job.RunAsUser == "" {
+		errno = -20
+		err = errors.New("RunAsErr")
+		goto ERR
+	}
+
+	//判断job的资源限制
+	if job.Resources.MemoryMax < 0 || job.Resources.CpuQuota < 0 || job.Resources.PidsMax < 0 {
+		errno = -21
+		err = errors.New("ResourcesErr")
+		goto ERR
+	}
+
+	//判断job的输出保留长度
+	if !common.CheckJobOutputLimit(&job.OutputLimit) {
+		errno = -23
+		err = errors.New("OutputLimitErr")
+		goto ERR
+	}
+
+	//判断job的周期性时间窗口
+	if _, err = common.ParseTimeWindows(job.TimeWindows); err != nil {
+		errno = -19
+		err = errors.New("TimeWindowErr")
+		goto ERR
+	}
+
+	//判断job的RRULE, 单独的错误码, 错误信息里带具体原因
+	if err = common.VerifyJobRRules(&job); err != nil {
+		errno = -18
+		goto ERR
+	}
+
+	//判断job的调度: cron表达式 / every间隔 / at执行时间 / rrule
+	if _, err = common.BuildJobSchedulePlan(&job); err != nil {
 		errno = -4
 		goto ERR
 	}
@@ -80,7 +135,7 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 
 	//判断job的开始时间
 	if job.StartTime != "" {
-		startTime = common.Str2Time(job.StartTime)
+		startTime = common.Str2TimeInLocation(job.StartTime, location)
 		if startTime.IsZero() {
 			errno = -6
 			err = errors.New("StartTimeErr")
@@ -90,7 +145,7 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 
 	//判断job的停止时间
 	if job.StopTime != "" {
-		stopTime = common.Str2Time(job.StopTime)
+		stopTime = common.Str2TimeInLocation(job.StopTime, location)
 		if stopTime.IsZero() {
 			errno = -7
 			err = errors.New("StopTimeErr")
@@ -112,8 +167,76 @@ func handleJobJudge(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	//返回正常应答({"errno": 0, "msg": "", "data": {....}})
-	if bytes, err = common.BuildResponse(0, "success", nil); err == nil {
+	//判断job的超时时间
+	if job.Timeout < 0 {
+		errno = -10
+		err = errors.New("TimeoutErr")
+		goto ERR
+	}
+
+	//判断job的强杀等待时间
+	if job.KillGracePeriod < 0 {
+		errno = -22
+		err = errors.New("KillGracePeriodErr")
+		goto ERR
+	}
+
+	//判断job的重试策略
+	if job.Retry.MaxAttempts < 0 || job.Retry.InitialDelay < 0 || job.Retry.BackoffFactor < 0 ||
+		(job.Retry.BackoffFactor > 0 && job.Retry.BackoffFactor < 1) {
+		errno = -11
+		err = errors.New("RetryErr")
+		goto ERR
+	}
+
+	//判断job的并发策略
+	switch job.ConcurrencyPolicy {
+	case "", common.CONCURRENCY_POLICY_FORBID, common.CONCURRENCY_POLICY_ALLOW, common.CONCURRENCY_POLICY_REPLACE:
+	default:
+		errno = -12
+		err = errors.New("ConcurrencyPolicyErr")
+		goto ERR
+	}
+
+	//判断job的补跑策略
+	switch job.MisfirePolicy {
+	case "", common.MISFIRE_POLICY_SKIP, common.MISFIRE_POLICY_ONCE, common.MISFIRE_POLICY_ALL:
+	default:
+		errno = -13
+		err = errors.New("MisfirePolicyErr")
+		goto ERR
+	}
+	if job.MisfireLimit < 0 {
+		errno = -13
+		err = errors.New("MisfirePolicyErr")
+		goto ERR
+	}
+
+	//判断job的执行模式
+	switch job.ExecuteMode {
+	case "", common.EXECUTE_MODE_SINGLE, common.EXECUTE_MODE_BROADCAST:
+	case common.EXECUTE_MODE_SHARD:
+		if job.ShardTotal <= 0 {
+			errno = -14
+			err = errors.New("ExecuteModeErr")
+			goto ERR
+		}
+	default:
+		errno = -14
+		err = errors.New("ExecuteModeErr")
+		goto ERR
+	}
+
+	//判断job引用的日历是否存在
+	if _, err = G_calendarMgr.LoadJobCalendars(&job); err != nil {
+		errno = -16
+		err = errors.New("CalendarErr")
+		goto ERR
+	}
+
+	//返回正常应答, 带上H替换后的cron表达式
+	common.FillResolvedCronExpr(&job)
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
 		resp.Write(bytes)
 	}
 	return
@@ -125,7 +248,7 @@ ERR:
 }
 
 //保存任务接口
-//POST job={"name": "job1", "command": "echo hello", "cronExpr": "* * * * *"}
+//POST user=admin&job={"namespace": "default", "name": "job1", "command": "echo hello", "cronExpr": "* * * * *"}
 func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err     error
@@ -148,8 +271,8 @@ func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	//4.保存到etcd
-	if oldJob, err = G_jobMgr.SaveJob(&job); err != nil {
+	//4.保存到etcd, 操作人记录到历史版本
+	if oldJob, err = G_jobMgr.SaveJob(&job, buildAuthor(req)); err != nil {
 		goto ERR
 	}
 
@@ -166,7 +289,7 @@ ERR:
 }
 
 //删除任务接口
-//POST /job/delete   name=job1
+//POST /job/delete   name=default/job1&user=admin
 func handleJobDelete(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err    error
@@ -183,7 +306,7 @@ func handleJobDelete(resp http.ResponseWriter, req *http.Request) {
 	name = req.PostForm.Get("name")
 
 	//去删除任务
-	if oldJob, err = G_jobMgr.DeleteJob(name); err != nil {
+	if oldJob, err = G_jobMgr.DeleteJob(name, buildAuthor(req)); err != nil {
 		goto ERR
 	}
 
@@ -199,6 +322,7 @@ ERR:
 }
 
 //列举所有crontab任务
+//GET /job/list?namespace=default  不传namespace列举所有命名空间
 func handleJobList(resp http.ResponseWriter, req *http.Request) {
 	var (
 		jobList []*common.Job
@@ -206,8 +330,13 @@ func handleJobList(resp http.ResponseWriter, req *http.Request) {
 		err     error
 	)
 
+	//解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
 	//获取任务列表
-	if jobList, err = G_jobMgr.ListJobs(); err != nil {
+	if jobList, err = G_jobMgr.ListJobs(req.Form.Get("namespace")); err != nil {
 		goto ERR
 	}
 
@@ -223,7 +352,7 @@ ERR:
 }
 
 //强制杀死某个任务
-// POST /job/kill  name=job1
+// POST /job/kill  name=default/job1
 func handleJobKill(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err   error
@@ -257,7 +386,7 @@ ERR:
 }
 
 //任务立即执行一次
-//POST /job/once  name=job1
+//POST /job/once  name=default/job1
 func handleJobOnce(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err   error
@@ -292,6 +421,143 @@ ERR:
 	}
 }
 
+//暂停任务
+//POST /job/pause  name=default/job1&user=admin
+func handleJobPause(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err   error
+		name  string
+		job   *common.Job
+		bytes []byte
+	)
+
+	//解析POST表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//要暂停的任务名
+	name = req.PostForm.Get("name")
+
+	if job, err = G_jobMgr.PauseJob(name, buildAuthor(req)); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//恢复任务
+//POST /job/resume  name=default/job1
+func handleJobResume(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err   error
+		name  string
+		job   *common.Job
+		bytes []byte
+	)
+
+	//解析POST表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//要恢复的任务名
+	name = req.PostForm.Get("name")
+
+	if job, err = G_jobMgr.ResumeJob(name, buildAuthor(req)); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//查询任务的历史版本
+//GET /job/history?name=default/job1
+func handleJobHistory(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		name         string
+		revisionList []*common.JobRevision
+		bytes        []byte
+	)
+
+	//解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.Form.Get("name")
+
+	if revisionList, err = G_jobMgr.ListJobHistory(name); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", revisionList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//回滚任务到某个历史版本
+//POST /job/rollback  name=default/job1&revision=3&user=admin
+func handleJobRollback(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		name     string
+		revision int
+		oldJob   *common.Job
+		bytes    []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.Form.Get("name")
+	if revision, err = strconv.Atoi(req.Form.Get("revision")); err != nil {
+		goto ERR
+	}
+
+	if oldJob, err = G_jobMgr.RollbackJob(name, revision, buildAuthor(req)); err != nil {
+		goto ERR
+	}
+
+	//正常应答, 返回回滚前的定义
+	if bytes, err = common.BuildResponse(0, "success", oldJob); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
 //查询任务日志
 func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -301,6 +567,8 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		limitParam string // 返回多少条
 		skip       int
 		limit      int
+		exitCode   int
+		query      *common.JobLogQuery
 		logArr     []*common.JobLog
 		bytes      []byte
 	)
@@ -310,8 +578,21 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	//获取请求参数 /job/log?name=job10&skip=0&limit=10
+	//获取请求参数 /job/log?name=default/job10&skip=0&limit=10&status=failed&exitCode=2&signal=SIGKILL&stdout=xxx&stderr=xxx
 	name = req.Form.Get("name")
+	query = &common.JobLogQuery{
+		Name:   name,
+		Status: req.Form.Get("status"),
+		Signal: req.Form.Get("signal"),
+		Stdout: req.Form.Get("stdout"),
+		Stderr: req.Form.Get("stderr"),
+	}
+	if req.Form.Get("exitCode") != "" {
+		if exitCode, err = strconv.Atoi(req.Form.Get("exitCode")); err != nil {
+			goto ERR
+		}
+		query.ExitCode = &exitCode
+	}
 	skipParam = req.Form.Get("skip")
 	limitParam = req.Form.Get("limit")
 	if skip, err = strconv.Atoi(skipParam); err != nil {
@@ -321,7 +602,7 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		limit = 20
 	}
 
-	if logArr, err = G_logMgr.ListLog(name, skip, limit); err != nil {
+	if logArr, err = G_logMgr.ListLog(query, skip, limit); err != nil {
 		goto ERR
 	}
 
@@ -337,6 +618,39 @@ ERR:
 	}
 }
 
+//查询一次运行的汇总结果
+//GET /job/run?runId=job1-1539000000000
+func handleJobRun(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		runId   string
+		summary *common.JobRunSummary
+		bytes   []byte
+	)
+
+	//解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	runId = req.Form.Get("runId")
+
+	if summary, err = G_logMgr.GetJobRun(runId); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", summary); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
 //查询任务最近工作节点
 func handleJobRecentWorker(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -385,7 +699,7 @@ ERR:
 //获取健康worker节点列表
 func handleWorkerList(resp http.ResponseWriter, req *http.Request) {
 	var (
-		workerArr []string
+		workerArr []*common.WorkerInfo
 		err       error
 		bytes     []byte
 	)
@@ -595,6 +909,519 @@ ERR:
 	}
 }
 
+//保存工作流
+//POST workflow={"name": "etl", "cronExpr": "0 2 * * *", "nodes": ["extract", "transform"], "edges": [{"from": "extract", "to": "transform"}]}
+func handleWorkflowSave(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		postWorkflow string
+		workflow     common.Workflow
+		oldWorkflow  *common.Workflow
+		bytes        []byte
+	)
+
+	//解析post表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//取表单中的workflow字段
+	postWorkflow = req.PostForm.Get("workflow")
+
+	//反序列化workflow
+	if err = json.Unmarshal([]byte(postWorkflow), &workflow); err != nil {
+		goto ERR
+	}
+
+	//保存到etcd
+	if oldWorkflow, err = G_workflowMgr.SaveWorkflow(&workflow); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldWorkflow); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//删除工作流
+//POST /workflow/delete  name=etl
+func handleWorkflowDelete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		name        string
+		oldWorkflow *common.Workflow
+		bytes       []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//删除的工作流名
+	name = req.PostForm.Get("name")
+
+	if oldWorkflow, err = G_workflowMgr.DeleteWorkflow(name); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldWorkflow); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//列举所有工作流
+func handleWorkflowList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		workflowList []*common.Workflow
+		bytes        []byte
+		err          error
+	)
+
+	if workflowList, err = G_workflowMgr.ListWorkflows(); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", workflowList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//手动触发一次工作流
+//POST /workflow/trigger  name=etl
+func handleWorkflowTrigger(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		name        string
+		workflowRun *common.WorkflowRun
+		bytes       []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//要触发的工作流名
+	name = req.PostForm.Get("name")
+
+	if workflowRun, err = G_workflowMgr.TriggerWorkflow(name); err != nil {
+		goto ERR
+	}
+
+	//正常应答, 返回运行记录(含运行ID)
+	if bytes, err = common.BuildResponse(0, "success", workflowRun); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//查询工作流运行记录
+//GET /workflow/runs?name=etl  列举运行记录
+//GET /workflow/runs?name=etl&runId=xxx  查看某次运行
+func handleWorkflowRuns(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		name        string
+		runId       string
+		runList     []*common.WorkflowRun
+		workflowRun *common.WorkflowRun
+		bytes       []byte
+	)
+
+	//解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.Form.Get("name")
+	runId = req.Form.Get("runId")
+
+	//指定了运行ID, 只返回这一次运行
+	if runId != "" {
+		if workflowRun, err = G_workflowMgr.GetWorkflowRun(name, runId); err != nil {
+			goto ERR
+		}
+		if bytes, err = common.BuildResponse(0, "success", workflowRun); err == nil {
+			resp.Write(bytes)
+		}
+		return
+	}
+
+	if runList, err = G_workflowMgr.ListWorkflowRuns(name); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", runList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//预览任务接下来的调度时间, 考虑时区/开始停止时间/暂停/日历, 与worker的计算一致
+//GET /job/preview?name=default/job1&n=10  预览已保存的任务
+//POST /job/preview  job={...}&n=10  保存前预览任务定义
+func handleJobPreview(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		name         string
+		postJob      string
+		n            int
+		job          *common.Job
+		savedJob     *common.Job
+		jobPlan      *common.JobSchedulePlan
+		previewTimes []common.JobPreviewTime
+		bytes        []byte
+	)
+
+	//解析参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if n, err = strconv.Atoi(req.Form.Get("n")); err != nil || n <= 0 {
+		n, err = 10, nil
+	}
+
+	if postJob = req.PostForm.Get("job"); postJob != "" {
+		//任务定义, 暂停状态以已保存的为准(保存时会保留)
+		if job, err = common.UnpackJob([]byte(postJob)); err != nil {
+			goto ERR
+		}
+		job.Paused = false
+		if savedJob, err = G_jobMgr.GetJob(common.BuildJobFullName(job.Namespace, job.Name)); err == nil {
+			job.Paused = savedJob.Paused
+		}
+		err = nil
+	} else {
+		name = req.Form.Get("name")
+		if job, err = G_jobMgr.GetJob(name); err != nil {
+			goto ERR
+		}
+	}
+
+	if jobPlan, err = common.BuildJobSchedulePlan(job); err != nil {
+		goto ERR
+	}
+	if jobPlan.Calendars, err = G_calendarMgr.LoadJobCalendars(job); err != nil {
+		goto ERR
+	}
+
+	previewTimes = common.BuildJobPreview(jobPlan, time.Now(), n)
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", previewTimes); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//集群调度负载预测: 每分钟的计划启动数, 按历史平均耗时估算的并发执行数, 超过在线worker数的分钟会被标记
+//GET /job/forecast?hours=24
+func handleJobForecast(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		hours        int
+		jobList      []*common.Job
+		job          *common.Job
+		jobPlan      *common.JobSchedulePlan
+		plans        []*common.JobSchedulePlan
+		calendarList []*common.Calendar
+		calendar     *common.Calendar
+		calendars    map[string]*common.Calendar
+		durations    map[string]time.Duration
+		workers      []*common.WorkerInfo
+		forecast     *common.LoadForecast
+		now          time.Time
+		bytes        []byte
+	)
+
+	//解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if hours, err = strconv.Atoi(req.Form.Get("hours")); err != nil || hours <= 0 {
+		hours, err = common.FORECAST_DEFAULT_HOURS, nil
+	}
+	if hours > common.FORECAST_MAX_HOURS {
+		hours = common.FORECAST_MAX_HOURS
+	}
+
+	//所有日历, 各任务共用
+	if calendarList, err = G_calendarMgr.ListCalendars(); err != nil {
+		goto ERR
+	}
+	calendars = make(map[string]*common.Calendar)
+	for _, calendar = range calendarList {
+		calendars[calendar.Name] = calendar
+	}
+
+	//所有任务的调度计划, 解析失败的任务worker也不会调度
+	if jobList, err = G_jobMgr.ListJobs(""); err != nil {
+		goto ERR
+	}
+	for _, job = range jobList {
+		if jobPlan, err = common.BuildJobSchedulePlan(job); err != nil {
+			continue
+		}
+		jobPlan.Calendars = calendars
+		plans = append(plans, jobPlan)
+	}
+	err = nil
+
+	//历史平均耗时和在线worker
+	now = time.Now()
+	if durations, err = G_logMgr.AverageDurations(now.AddDate(0, 0, -common.FORECAST_HISTORY_DAYS)); err != nil {
+		goto ERR
+	}
+	if workers, err = G_workerMgr.ListWorkers(); err != nil {
+		goto ERR
+	}
+
+	forecast = common.BuildLoadForecast(plans, durations, workers, now, time.Duration(hours)*time.Hour)
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", forecast); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//保存日历
+//POST /calendar/save  calendar={"name": "holidays", "dates": ["2026-10-01"]}
+func handleCalendarSave(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		postCalendar string
+		calendar     common.Calendar
+		oldCalendar  *common.Calendar
+		bytes        []byte
+	)
+
+	//解析post表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//反序列化calendar
+	postCalendar = req.PostForm.Get("calendar")
+	if err = json.Unmarshal([]byte(postCalendar), &calendar); err != nil {
+		goto ERR
+	}
+
+	//保存到etcd
+	if oldCalendar, err = G_calendarMgr.SaveCalendar(&calendar); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldCalendar); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//导入iCalendar文件
+//POST /calendar/import  name=holidays&details=xxx&ics=BEGIN:VCALENDAR...
+func handleCalendarImport(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		calendar *common.Calendar
+		bytes    []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if calendar, err = G_calendarMgr.ImportCalendar(req.PostForm.Get("name"), req.PostForm.Get("details"), req.PostForm.Get("ics")); err != nil {
+		goto ERR
+	}
+
+	//正常应答, 返回导入后的日历
+	if bytes, err = common.BuildResponse(0, "success", calendar); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//删除日历
+//POST /calendar/delete  name=holidays
+func handleCalendarDelete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		oldCalendar *common.Calendar
+		bytes       []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if oldCalendar, err = G_calendarMgr.DeleteCalendar(req.PostForm.Get("name")); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldCalendar); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//列举所有日历
+func handleCalendarList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		calendarList []*common.Calendar
+		bytes        []byte
+		err          error
+	)
+
+	if calendarList, err = G_calendarMgr.ListCalendars(); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", calendarList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//设置集群维护冻结
+//POST /freeze/set  freeze={"reason":"机房迁移","endTime":"2019-01-01 06:00:00","namespaces":[],"labels":{}}
+func handleFreezeSet(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		postFreeze string
+		freeze     common.Freeze
+		oldFreeze  *common.Freeze
+		bytes      []byte
+	)
+
+	//解析post表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	//反序列化freeze
+	postFreeze = req.PostForm.Get("freeze")
+	if err = json.Unmarshal([]byte(postFreeze), &freeze); err != nil {
+		goto ERR
+	}
+
+	//保存到etcd
+	if oldFreeze, err = G_freezeMgr.SetFreeze(&freeze, buildAuthor(req)); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldFreeze); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//解除集群维护冻结
+//POST /freeze/clear
+func handleFreezeClear(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		oldFreeze *common.Freeze
+		bytes     []byte
+	)
+
+	if oldFreeze, err = G_freezeMgr.ClearFreeze(); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", oldFreeze); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+//查询当前集群维护冻结, 没有冻结时data为null
+func handleFreezeGet(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		freeze *common.Freeze
+		bytes  []byte
+	)
+
+	if freeze, err = G_freezeMgr.GetFreeze(); err != nil {
+		goto ERR
+	}
+
+	//正常应答
+	if bytes, err = common.BuildResponse(0, "success", freeze); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
 //初始化服务
 func InitApiServer() (err error) {
 	var (
@@ -612,12 +1439,31 @@ func InitApiServer() (err error) {
 	mux.HandleFunc("/job/list", handleJobList)
 	mux.HandleFunc("/job/kill", handleJobKill)
 	mux.HandleFunc("/job/once", handleJobOnce)
+	mux.HandleFunc("/job/pause", handleJobPause)
+	mux.HandleFunc("/job/resume", handleJobResume)
 	mux.HandleFunc("/job/log", handleJobLog)
+	mux.HandleFunc("/job/history", handleJobHistory)
+	mux.HandleFunc("/job/rollback", handleJobRollback)
+	mux.HandleFunc("/job/run", handleJobRun)
 	mux.HandleFunc("/job/recentworker", handleJobRecentWorker)
+	mux.HandleFunc("/job/preview", handleJobPreview)
+	mux.HandleFunc("/job/forecast", handleJobForecast)
 	mux.HandleFunc("/worker/list", handleWorkerList)
 	mux.HandleFunc("/worker/add", handleWorkerAdd)
 	mux.HandleFunc("/worker/delete", handleWorkerDelete)
 	mux.HandleFunc("/worker/judge", handleWorkerJudge)
+	mux.HandleFunc("/workflow/save", handleWorkflowSave)
+	mux.HandleFunc("/workflow/delete", handleWorkflowDelete)
+	mux.HandleFunc("/workflow/list", handleWorkflowList)
+	mux.HandleFunc("/workflow/trigger", handleWorkflowTrigger)
+	mux.HandleFunc("/workflow/runs", handleWorkflowRuns)
+	mux.HandleFunc("/calendar/save", handleCalendarSave)
+	mux.HandleFunc("/calendar/import", handleCalendarImport)
+	mux.HandleFunc("/calendar/delete", handleCalendarDelete)
+	mux.HandleFunc("/calendar/list", handleCalendarList)
+	mux.HandleFunc("/freeze/set", handleFreezeSet)
+	mux.HandleFunc("/freeze/clear", handleFreezeClear)
+	mux.HandleFunc("/freeze/get", handleFreezeGet)
 
 	///index.html
 	//静态文件目录
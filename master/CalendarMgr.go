@@ -0,0 +1,171 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/gyyn/crontab/common"
+)
+
+//日历管理器
+type CalendarMgr struct {
+	client *clientv3.Client
+	kv     clientv3.KV
+}
+
+var (
+	//单例
+	G_calendarMgr *CalendarMgr
+)
+
+//初始化
+func InitCalendarMgr() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	//初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond,
+	}
+
+	//建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	//赋值单例
+	G_calendarMgr = &CalendarMgr{
+		client: client,
+		kv:     clientv3.NewKV(client),
+	}
+	return
+}
+
+//保存日历
+func (calendarMgr *CalendarMgr) SaveCalendar(calendar *common.Calendar) (oldCalendar *common.Calendar, err error) {
+	var (
+		calendarValue []byte
+		putResp       *clientv3.PutResponse
+	)
+
+	//校验日期格式
+	if err = common.VerifyCalendar(calendar); err != nil {
+		return
+	}
+	calendar.Dates = common.StrSliceRemoveRepeat(calendar.Dates)
+	sort.Strings(calendar.Dates)
+
+	if calendarValue, err = json.Marshal(calendar); err != nil {
+		return
+	}
+
+	//保存到etcd
+	if putResp, err = calendarMgr.kv.Put(context.TODO(), common.JOB_CALENDAR_DIR+calendar.Name, string(calendarValue), clientv3.WithPrevKV()); err != nil {
+		return
+	}
+
+	//如果是更新，返回旧值
+	if putResp.PrevKv != nil {
+		if oldCalendar, err = common.UnpackCalendar(putResp.PrevKv.Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//导入iCalendar文件, 覆盖同名日历
+func (calendarMgr *CalendarMgr) ImportCalendar(name string, details string, ics string) (calendar *common.Calendar, err error) {
+	var (
+		dates []string
+	)
+
+	if dates, err = common.ParseICalendarDates(ics); err != nil {
+		return
+	}
+
+	calendar = &common.Calendar{
+		Name:    name,
+		Dates:   dates,
+		Details: details,
+	}
+	_, err = calendarMgr.SaveCalendar(calendar)
+	return
+}
+
+//删除日历
+func (calendarMgr *CalendarMgr) DeleteCalendar(name string) (oldCalendar *common.Calendar, err error) {
+	var (
+		delResp *clientv3.DeleteResponse
+	)
+
+	//从etcd中删除它
+	if delResp, err = calendarMgr.kv.Delete(context.TODO(), common.JOB_CALENDAR_DIR+name, clientv3.WithPrevKV()); err != nil {
+		return
+	}
+
+	//返回被删除的日历
+	if len(delResp.PrevKvs) != 0 {
+		if oldCalendar, err = common.UnpackCalendar(delResp.PrevKvs[0].Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//列举日历
+func (calendarMgr *CalendarMgr) ListCalendars() (calendarList []*common.Calendar, err error) {
+	var (
+		getResp  *clientv3.GetResponse
+		kvPair   *mvccpb.KeyValue
+		calendar *common.Calendar
+	)
+
+	//获取目录下所有日历
+	if getResp, err = calendarMgr.kv.Get(context.TODO(), common.JOB_CALENDAR_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+
+	calendarList = make([]*common.Calendar, 0)
+	for _, kvPair = range getResp.Kvs {
+		if calendar, err = common.UnpackCalendar(kvPair.Value); err != nil {
+			err = nil
+			continue
+		}
+		calendarList = append(calendarList, calendar)
+	}
+	return
+}
+
+//读取任务引用的日历, 按日历名索引
+func (calendarMgr *CalendarMgr) LoadJobCalendars(job *common.Job) (calendars map[string]*common.Calendar, err error) {
+	var (
+		names    []string
+		name     string
+		getResp  *clientv3.GetResponse
+		calendar *common.Calendar
+	)
+
+	calendars = make(map[string]*common.Calendar)
+	names = append(append(names, job.IncludeCalendars...), job.ExcludeCalendars...)
+	for _, name = range common.StrSliceRemoveRepeat(names) {
+		if getResp, err = calendarMgr.kv.Get(context.TODO(), common.JOB_CALENDAR_DIR+name); err != nil {
+			return
+		}
+		if len(getResp.Kvs) == 0 {
+			err = common.ERR_CALENDAR_NOT_FOUND
+			return
+		}
+		if calendar, err = common.UnpackCalendar(getResp.Kvs[0].Value); err != nil {
+			return
+		}
+		calendars[name] = calendar
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/gyyn/crontab/common"
+)
+
+//集群冻结管理器
+type FreezeMgr struct {
+	client *clientv3.Client
+	kv     clientv3.KV
+	lease  clientv3.Lease
+}
+
+var (
+	//单例
+	G_freezeMgr *FreezeMgr
+)
+
+//初始化
+func InitFreezeMgr() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	//初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond,
+	}
+
+	//建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	//赋值单例
+	G_freezeMgr = &FreezeMgr{
+		client: client,
+		kv:     clientv3.NewKV(client),
+		lease:  clientv3.NewLease(client),
+	}
+	return
+}
+
+//设置集群冻结, 覆盖已有的冻结
+func (freezeMgr *FreezeMgr) SetFreeze(freeze *common.Freeze, author string) (oldFreeze *common.Freeze, err error) {
+	var (
+		now            time.Time
+		endTime        time.Time
+		freezeValue    []byte
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		opts           []clientv3.OpOption
+		putResp        *clientv3.PutResponse
+	)
+
+	if freeze.Reason == "" {
+		err = common.ERR_FREEZE_REASON
+		return
+	}
+
+	now = time.Now()
+	freeze.EndAt = 0
+	if freeze.EndTime != "" {
+		if endTime = common.Str2Time(freeze.EndTime); endTime.IsZero() || !endTime.After(now) {
+			err = common.ERR_FREEZE_END_TIME
+			return
+		}
+		freeze.EndAt = endTime.UnixNano() / 1000 / 1000
+
+		//到结束时间后key随租约自动删除, worker据此解除冻结
+		if leaseGrantResp, err = freezeMgr.lease.Grant(context.TODO(), int64(endTime.Sub(now)/time.Second)+1); err != nil {
+			return
+		}
+		opts = append(opts, clientv3.WithLease(leaseGrantResp.ID))
+	}
+	freeze.Author = author
+	freeze.CreatedAt = now.UnixNano() / 1000 / 1000
+
+	if freezeValue, err = json.Marshal(freeze); err != nil {
+		return
+	}
+
+	//保存到etcd
+	opts = append(opts, clientv3.WithPrevKV())
+	if putResp, err = freezeMgr.kv.Put(context.TODO(), common.JOB_FREEZE_KEY, string(freezeValue), opts...); err != nil {
+		return
+	}
+
+	//如果是更新，返回旧值
+	if putResp.PrevKv != nil {
+		if oldFreeze, err = common.UnpackFreeze(putResp.PrevKv.Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//解除集群冻结
+func (freezeMgr *FreezeMgr) ClearFreeze() (oldFreeze *common.Freeze, err error) {
+	var (
+		delResp *clientv3.DeleteResponse
+	)
+
+	if delResp, err = freezeMgr.kv.Delete(context.TODO(), common.JOB_FREEZE_KEY, clientv3.WithPrevKV()); err != nil {
+		return
+	}
+
+	//返回被解除的冻结
+	if len(delResp.PrevKvs) != 0 {
+		if oldFreeze, err = common.UnpackFreeze(delResp.PrevKvs[0].Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//查询当前冻结, 没有冻结时返回nil
+func (freezeMgr *FreezeMgr) GetFreeze() (freeze *common.Freeze, err error) {
+	var (
+		getResp *clientv3.GetResponse
+	)
+
+	if getResp, err = freezeMgr.kv.Get(context.TODO(), common.JOB_FREEZE_KEY); err != nil {
+		return
+	}
+
+	if len(getResp.Kvs) != 0 {
+		freeze, err = common.UnpackFreeze(getResp.Kvs[0].Value)
+	}
+	return
+}
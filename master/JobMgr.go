@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/etcd/mvcc/mvccpb"
@@ -57,74 +60,286 @@ func InitJobMgr() (err error) {
 		lease:  lease,
 	}
 
+	//迁移旧的任务key
+	err = G_jobMgr.migrateLegacyJobs()
 	return
 }
 
-//保存任务
-func (jobMgr *JobMgr) SaveJob(job *common.Job) (oldJob *common.Job, err error) {
-	//把任务保存到/cron/jobs/任务名 -> json
+//把引入命名空间之前的/cron/jobs任务名迁移到/cron/jobs/default/任务名
+//新key已存在时保留旧key不动, 由人工处理; killer和once的key只存在1秒, 不需要迁移
+func (jobMgr *JobMgr) migrateLegacyJobs() (err error) {
 	var (
-		jobKey    string
-		jobValue  []byte
-		putResp   *clientv3.PutResponse
-		oldJobObj common.Job
+		getResp *clientv3.GetResponse
+		kvPair  *mvccpb.KeyValue
+		oldKey  string
+		newKey  string
+		name    string
+		job     *common.Job
+		value   []byte
+		txnResp *clientv3.TxnResponse
 	)
 
-	//etcd的保存key
-	jobKey = common.JOB_SAVE_DIR + job.Name
-	if jobValue, err = json.Marshal(job); err != nil {
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_LEGACY_SAVE_DIR, clientv3.WithPrefix()); err != nil {
 		return
 	}
 
-	//保存到etcd
-	if putResp, err = jobMgr.kv.Put(context.TODO(), jobKey, string(jobValue), clientv3.WithPrevKV()); err != nil {
-		return
-	}
+	for _, kvPair = range getResp.Kvs {
+		oldKey = string(kvPair.Key)
+		if strings.HasPrefix(oldKey, common.JOB_SAVE_DIR) {
+			continue //已经是新的key
+		}
 
-	//如果是更新，返回旧值
-	if putResp.PrevKv != nil {
-		//对旧值反序列化
-		if err = json.Unmarshal(putResp.PrevKv.Value, &oldJobObj); err != nil {
+		name = strings.TrimPrefix(oldKey, common.JOB_LEGACY_SAVE_DIR)
+		if !common.VerifyJobName(name) {
+			fmt.Println("跳过无法迁移的任务:", oldKey)
+			continue
+		}
+		if job, err = common.UnpackJob(kvPair.Value); err != nil {
+			fmt.Println("跳过无法迁移的任务:", oldKey, err)
 			err = nil
+			continue
+		}
+		job.Namespace = common.JOB_DEFAULT_NAMESPACE
+		job.Name = name
+		if value, err = json.Marshal(job); err != nil {
 			return
 		}
-		oldJob = &oldJobObj
+
+		//新key不存在, 且旧key没有被修改过时才迁移
+		newKey = common.JOB_SAVE_DIR + common.BuildJobFullName(job.Namespace, job.Name)
+		if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0),
+				clientv3.Compare(clientv3.ModRevision(oldKey), "=", kvPair.ModRevision)).
+			Then(clientv3.OpPut(newKey, string(value)), clientv3.OpDelete(oldKey)).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			fmt.Println("迁移任务:", oldKey, "->", newKey)
+		} else {
+			fmt.Println("任务已存在, 未迁移:", oldKey, "->", newKey)
+		}
 	}
+	return
+}
 
+//保存任务, 同时记录一个历史版本
+func (jobMgr *JobMgr) SaveJob(job *common.Job, author string) (oldJob *common.Job, err error) {
+	//把任务保存到/cron/jobs/命名空间/任务名 -> json
+	var (
+		fullName   string
+		jobKey     string
+		jobValue   []byte
+		getResp    *clientv3.GetResponse
+		modRev     int64
+		revision   int
+		historyKey string
+		history    []byte
+		txnResp    *clientv3.TxnResponse
+		i          int
+	)
+
+	//etcd的保存key
+	if job.Namespace == "" {
+		job.Namespace = common.JOB_DEFAULT_NAMESPACE
+	}
+	fullName = common.BuildJobFullName(job.Namespace, job.Name)
+	jobKey = common.JOB_SAVE_DIR + fullName
+
+	//乐观锁保存, 任务和历史版本在同一个事务里写入
+	for {
+		//读取当前定义
+		if getResp, err = jobMgr.kv.Get(context.TODO(), jobKey); err != nil {
+			return
+		}
+		oldJob, modRev = nil, 0
+		if len(getResp.Kvs) != 0 {
+			modRev = getResp.Kvs[0].ModRevision
+			if oldJob, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil {
+				oldJob, err = nil, nil
+			}
+		}
+
+		//暂停状态不属于任务定义, 修改任务时保留
+		job.Paused, job.PausedBy, job.PausedAt = false, "", ""
+		if oldJob != nil {
+			job.Paused = oldJob.Paused
+			job.PausedBy = oldJob.PausedBy
+			job.PausedAt = oldJob.PausedAt
+		}
+
+		//完成状态同理, 只有调度不变时才保留, 改了执行时间会重新调度
+		job.Completed, job.CompletedAt = false, ""
+		if oldJob != nil && reflect.DeepEqual(common.BuildJobSchedules(oldJob), common.BuildJobSchedules(job)) {
+			job.Completed = oldJob.Completed
+			job.CompletedAt = oldJob.CompletedAt
+		}
+
+		//H替换后的表达式由任务名决定, 不保存
+		job.ResolvedCronExpr = ""
+		for i = range job.Schedules {
+			job.Schedules[i].ResolvedCronExpr = ""
+		}
+
+		if jobValue, err = json.Marshal(job); err != nil {
+			return
+		}
+
+		//历史版本
+		if revision, err = common.LastJobRevision(jobMgr.kv, fullName); err != nil {
+			return
+		}
+		revision++
+		historyKey = common.BuildJobHistoryKey(fullName, revision)
+		if history, err = json.Marshal(&common.JobRevision{
+			Revision:  revision,
+			Namespace: job.Namespace,
+			Name:      job.Name,
+			Action:    common.JOB_ACTION_SAVE,
+			Author:    author,
+			Time:      time.Now().Format("2006-01-02 15:04:05"),
+			Job:       job,
+			Diff:      common.BuildJobDiff(oldJob, job),
+		}); err != nil {
+			return
+		}
+
+		//保存到etcd
+		if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", modRev),
+				clientv3.Compare(clientv3.CreateRevision(historyKey), "=", 0)).
+			Then(clientv3.OpPut(jobKey, string(jobValue)), clientv3.OpPut(historyKey, string(history))).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			break
+		}
+	}
+
+	common.PruneJobHistory(jobMgr.kv, fullName, revision)
 	return
 }
 
-//删除任务
-func (jobMgr *JobMgr) DeleteJob(name string) (oldJob *common.Job, err error) {
+//删除任务, name为命名空间/任务名, 同时记录一个历史版本
+func (jobMgr *JobMgr) DeleteJob(name string, author string) (oldJob *common.Job, err error) {
 	var (
-		jobKey    string
-		delResp   *clientv3.DeleteResponse
-		oldJobObj common.Job
+		jobKey     string
+		getResp    *clientv3.GetResponse
+		revision   int
+		historyKey string
+		history    []byte
+		txnResp    *clientv3.TxnResponse
+		namespace  string
+		jobName    string
 	)
 
 	//etcd中保存任务的key
+	name = common.NormalizeJobFullName(name)
 	jobKey = common.JOB_SAVE_DIR + name
+	namespace, jobName = common.ExtractJobNamespace(name)
+
+	for {
+		//读取当前定义, 不存在则无需删除
+		if getResp, err = jobMgr.kv.Get(context.TODO(), jobKey); err != nil {
+			return
+		}
+		if len(getResp.Kvs) == 0 {
+			oldJob = nil
+			return
+		}
+		if oldJob, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil {
+			oldJob, err = nil, nil
+		}
+
+		//历史版本
+		if revision, err = common.LastJobRevision(jobMgr.kv, name); err != nil {
+			return
+		}
+		revision++
+		historyKey = common.BuildJobHistoryKey(name, revision)
+		if history, err = json.Marshal(&common.JobRevision{
+			Revision:  revision,
+			Namespace: namespace,
+			Name:      jobName,
+			Action:    common.JOB_ACTION_DELETE,
+			Author:    author,
+			Time:      time.Now().Format("2006-01-02 15:04:05"),
+			Diff:      common.BuildJobDiff(oldJob, nil),
+		}); err != nil {
+			return
+		}
+
+		//从etcd中删除它, 上次调度时间一起删掉, 以后重建同名任务时不会补跑旧任务的调度
+		if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", getResp.Kvs[0].ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(historyKey), "=", 0)).
+			Then(clientv3.OpDelete(jobKey), clientv3.OpDelete(common.JOB_LAST_RUN_DIR+name),
+				clientv3.OpPut(historyKey, string(history))).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			break
+		}
+	}
+
+	common.PruneJobHistory(jobMgr.kv, name, revision)
+	return
+}
+
+//列举任务的历史版本, 最新的在前
+func (jobMgr *JobMgr) ListJobHistory(name string) (revisionList []*common.JobRevision, err error) {
+	var (
+		getResp     *clientv3.GetResponse
+		kvPair      *mvccpb.KeyValue
+		jobRevision *common.JobRevision
+	)
 
-	//从etcd中删除它
-	if delResp, err = jobMgr.kv.Delete(context.TODO(), jobKey, clientv3.WithPrevKV()); err != nil {
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_HISTORY_DIR+common.NormalizeJobFullName(name)+"/",
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend)); err != nil {
 		return
 	}
 
-	//返回被删除的任务信息
-	if len(delResp.PrevKvs) != 0 {
-		//解析旧值，返回它
-		if err = json.Unmarshal(delResp.PrevKvs[0].Value, &oldJobObj); err != nil {
+	revisionList = make([]*common.JobRevision, 0)
+	for _, kvPair = range getResp.Kvs {
+		jobRevision = &common.JobRevision{}
+		if err = json.Unmarshal(kvPair.Value, jobRevision); err != nil {
 			err = nil
-			return
+			continue
 		}
-		oldJob = &oldJobObj
+		revisionList = append(revisionList, jobRevision)
 	}
-
 	return
 }
 
-//列举任务
-func (jobMgr *JobMgr) ListJobs() (jobList []*common.Job, err error) {
+//回滚到某个历史版本, 通过正常的保存流程写入(会产生一个新版本)
+func (jobMgr *JobMgr) RollbackJob(name string, revision int, author string) (oldJob *common.Job, err error) {
+	var (
+		getResp     *clientv3.GetResponse
+		jobRevision common.JobRevision
+	)
+
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.BuildJobHistoryKey(common.NormalizeJobFullName(name), revision)); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_REVISION_NOT_FOUND
+		return
+	}
+	if err = json.Unmarshal(getResp.Kvs[0].Value, &jobRevision); err != nil {
+		return
+	}
+	if jobRevision.Job == nil {
+		err = common.ERR_JOB_REVISION_DELETED
+		return
+	}
+
+	return jobMgr.SaveJob(jobRevision.Job, author)
+}
+
+//列举任务, namespace为空时列举所有命名空间
+func (jobMgr *JobMgr) ListJobs(namespace string) (jobList []*common.Job, err error) {
 	var (
 		dirKey  string
 		getResp *clientv3.GetResponse
@@ -134,6 +349,9 @@ func (jobMgr *JobMgr) ListJobs() (jobList []*common.Job, err error) {
 
 	//任务保存的目录
 	dirKey = common.JOB_SAVE_DIR
+	if namespace != "" {
+		dirKey = common.JOB_SAVE_DIR + namespace + "/"
+	}
 
 	//获取目录下所有任务信息
 	if getResp, err = jobMgr.kv.Get(context.TODO(), dirKey, clientv3.WithPrefix()); err != nil {
@@ -146,17 +364,132 @@ func (jobMgr *JobMgr) ListJobs() (jobList []*common.Job, err error) {
 
 	//遍历所有任务，进行反序列化
 	for _, kvPair = range getResp.Kvs {
-		job = &common.Job{}
-		if err = json.Unmarshal(kvPair.Value, job); err != nil {
+		if job, err = common.UnpackJob(kvPair.Value); err != nil {
 			err = nil
 			continue
 		}
+		//展示H替换后的cron表达式
+		common.FillResolvedCronExpr(job)
 		jobList = append(jobList, job)
 	}
 
 	return
 }
 
+//暂停任务, 任务定义保留, worker不再启动它
+func (jobMgr *JobMgr) PauseJob(name string, pausedBy string) (job *common.Job, err error) {
+	return jobMgr.updatePaused(name, true, pausedBy)
+}
+
+//恢复任务
+func (jobMgr *JobMgr) ResumeJob(name string, author string) (job *common.Job, err error) {
+	return jobMgr.updatePaused(name, false, author)
+}
+
+//修改任务的暂停状态, 和修改任务一样记录操作人和历史版本
+func (jobMgr *JobMgr) updatePaused(name string, paused bool, author string) (job *common.Job, err error) {
+	var (
+		jobKey     string
+		getResp    *clientv3.GetResponse
+		oldJob     *common.Job
+		jobValue   []byte
+		revision   int
+		historyKey string
+		history    []byte
+		ops        []clientv3.Op
+		txnResp    *clientv3.TxnResponse
+	)
+
+	name = common.NormalizeJobFullName(name)
+	jobKey = common.JOB_SAVE_DIR + name
+
+	//乐观锁更新, 冲突时重新读取
+	for {
+		if getResp, err = jobMgr.kv.Get(context.TODO(), jobKey); err != nil {
+			return
+		}
+		if len(getResp.Kvs) == 0 {
+			err = common.ERR_JOB_NOT_FOUND
+			return
+		}
+		if oldJob, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil {
+			return
+		}
+		if job, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil {
+			return
+		}
+
+		job.Paused = paused
+		if paused {
+			job.PausedBy = author
+			job.PausedAt = time.Now().Format("2006-01-02 15:04:05")
+		} else {
+			job.PausedBy = ""
+			job.PausedAt = ""
+		}
+		if jobValue, err = json.Marshal(job); err != nil {
+			return
+		}
+
+		//历史版本
+		if revision, err = common.LastJobRevision(jobMgr.kv, name); err != nil {
+			return
+		}
+		revision++
+		historyKey = common.BuildJobHistoryKey(name, revision)
+		if history, err = json.Marshal(&common.JobRevision{
+			Revision:  revision,
+			Namespace: job.Namespace,
+			Name:      job.Name,
+			Action:    common.JOB_ACTION_SAVE,
+			Author:    author,
+			Time:      time.Now().Format("2006-01-02 15:04:05"),
+			Job:       job,
+			Diff:      common.BuildJobDiff(oldJob, job),
+		}); err != nil {
+			return
+		}
+
+		ops = []clientv3.Op{clientv3.OpPut(jobKey, string(jobValue)), clientv3.OpPut(historyKey, string(history))}
+
+		//恢复时推进最近一次执行过的计划时间, 暂停期间的调度不补跑
+		if !paused {
+			ops = append(ops, clientv3.OpPut(common.JOB_LAST_RUN_DIR+name, strconv.FormatInt(time.Now().UnixNano()/1000/1000, 10)))
+		}
+
+		if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", getResp.Kvs[0].ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(historyKey), "=", 0)).
+			Then(ops...).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			break
+		}
+	}
+
+	common.PruneJobHistory(jobMgr.kv, name, revision)
+	return
+}
+
+//读取一个任务
+func (jobMgr *JobMgr) GetJob(name string) (job *common.Job, err error) {
+	var (
+		getResp *clientv3.GetResponse
+	)
+
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_SAVE_DIR+common.NormalizeJobFullName(name)); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	job, err = common.UnpackJob(getResp.Kvs[0].Value)
+	return
+}
+
 //杀死任务
 func (jobMgr *JobMgr) KillJob(name string) (err error) {
 	//更新一下key=/cron/killer/任务名
@@ -167,7 +500,7 @@ func (jobMgr *JobMgr) KillJob(name string) (err error) {
 	)
 
 	//通知worker杀死对应任务
-	killerKey = common.JOB_KILLER_DIR + name
+	killerKey = common.JOB_KILLER_DIR + common.NormalizeJobFullName(name)
 
 	//让worker监听到一次put操作, 创建一个租约让其稍后自动过期即可
 	if leaseGrantResp, err = jobMgr.lease.Grant(context.TODO(), 1); err != nil {
@@ -195,7 +528,7 @@ func (jobMgr *JobMgr) OnceJob(name string) (err error) {
 	)
 
 	//通知worker立即执行对应任务
-	OnceKey = common.JOB_ONCE_DIR + name
+	OnceKey = common.JOB_ONCE_DIR + common.NormalizeJobFullName(name)
 
 	//让worker监听到一次put操作, 创建一个租约让其稍后自动过期即可
 	if leaseGrantResp, err = jobMgr.lease.Grant(context.TODO(), 1); err != nil {
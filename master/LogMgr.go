@@ -2,9 +2,12 @@ package master
 
 import (
 	"context"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gyyn/crontab/common"
+	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/mongo"
 	"github.com/mongodb/mongo-go-driver/mongo/clientopt"
 	"github.com/mongodb/mongo-go-driver/mongo/findopt"
@@ -40,20 +43,47 @@ func InitLogMgr() (err error) {
 	return
 }
 
-//查看任务日志
-func (logMgr *LogMgr) ListLog(name string, skip int, limit int) (logArr []*common.JobLog, err error) {
+//查看任务日志, name为命名空间/任务名
+func (logMgr *LogMgr) ListLog(query *common.JobLogQuery, skip int, limit int) (logArr []*common.JobLog, err error) {
 	var (
-		filter  *common.JobLogFilter
-		logSort *common.SortLogByStartTime
-		cursor  mongo.Cursor
-		jobLog  *common.JobLog
+		filter    *bson.Document
+		namespace string
+		jobName   string
+		logSort   *common.SortLogByStartTime
+		cursor    mongo.Cursor
+		jobLog    *common.JobLog
 	)
 
 	//len(logArr)
 	logArr = make([]*common.JobLog, 0)
 
 	//过滤条件
-	filter = &common.JobLogFilter{JobName: name}
+	namespace, jobName = common.ExtractJobNamespace(query.Name)
+	filter = bson.NewDocument(bson.EC.String("namespace", namespace), bson.EC.String("jobName", jobName))
+	if namespace == common.JOB_DEFAULT_NAMESPACE {
+		//引入命名空间之前的日志没有namespace字段, 属于default
+		filter = bson.NewDocument(
+			bson.EC.SubDocument("namespace", bson.NewDocument(
+				bson.EC.Array("$in", bson.NewArray(bson.VC.String(namespace), bson.VC.Null())),
+			)),
+			bson.EC.String("jobName", jobName),
+		)
+	}
+	if query.Status != "" {
+		filter.Append(bson.EC.String("status", query.Status))
+	}
+	if query.ExitCode != nil {
+		filter.Append(bson.EC.Int64("exitCode", int64(*query.ExitCode)))
+	}
+	if query.Signal != "" {
+		filter.Append(bson.EC.String("signal", query.Signal))
+	}
+	if query.Stdout != "" {
+		filter.Append(bson.EC.Regex("stdout", regexp.QuoteMeta(query.Stdout), ""))
+	}
+	if query.Stderr != "" {
+		filter.Append(bson.EC.Regex("stderr", regexp.QuoteMeta(query.Stderr), ""))
+	}
 
 	//按照任务开始时间倒排
 	logSort = &common.SortLogByStartTime{SortOrder: -1}
@@ -78,6 +108,136 @@ func (logMgr *LogMgr) ListLog(name string, skip int, limit int) (logArr []*commo
 	return
 }
 
+//按运行ID汇总一次运行的结果
+//分片模式下每个分片都要成功, 其他模式下每个执行的worker都要成功, 重试后成功也算成功
+func (logMgr *LogMgr) GetJobRun(runId string) (summary *common.JobRunSummary, err error) {
+	var (
+		filter    *common.JobRunLogFilter
+		cursor    mongo.Cursor
+		jobLog    *common.JobLog
+		unit      string
+		unitOk    map[string]bool
+		ok        bool
+		shardNum  int
+		isSuccess bool
+	)
+
+	summary = &common.JobRunSummary{
+		RunId: runId,
+		Logs:  make([]*common.JobLog, 0),
+	}
+
+	//过滤条件
+	filter = &common.JobRunLogFilter{RunId: runId}
+
+	if cursor, err = logMgr.logCollection.Find(context.TODO(), filter); err != nil {
+		return
+	}
+	//延迟释放游标
+	defer cursor.Close(context.TODO())
+
+	//每个分片(或worker)是否有成功的结果
+	unitOk = make(map[string]bool)
+	for cursor.Next(context.TODO()) {
+		jobLog = &common.JobLog{}
+
+		//反序列化BSON
+		if err = cursor.Decode(jobLog); err != nil {
+			continue //有日志不合法
+		}
+
+		//抢锁失败的worker没有执行, 不计入汇总
+		if jobLog.Status == common.JOB_STATUS_LOCK_CONFLICT {
+			continue
+		}
+
+		summary.JobName = jobLog.JobName
+		summary.Logs = append(summary.Logs, jobLog)
+
+		//跳过的调度只展示原因, 不算作分片(或worker)的失败, 和平均耗时的统计一致
+		if jobLog.IsSkipped || jobLog.Status == common.JOB_STATUS_SKIPPED {
+			summary.SkippedNum++
+			continue
+		}
+		summary.Total++
+
+		isSuccess = jobLog.Err == ""
+		if isSuccess {
+			summary.SuccessNum++
+		} else {
+			summary.FailedNum++
+		}
+
+		if jobLog.ShardTotal > 0 {
+			unit = strconv.Itoa(jobLog.ShardIndex)
+			shardNum = jobLog.ShardTotal
+		} else {
+			unit = jobLog.LocalIP
+		}
+		unitOk[unit] = unitOk[unit] || isSuccess
+	}
+	err = nil
+
+	summary.Success = len(unitOk) != 0
+	if shardNum > 0 && len(unitOk) != shardNum {
+		summary.Success = false
+	}
+	for _, ok = range unitOk {
+		summary.Success = summary.Success && ok
+	}
+	return
+}
+
+//统计since之后各任务的平均耗时, key为命名空间/任务名, 跳过的调度不计入
+func (logMgr *LogMgr) AverageDurations(since time.Time) (durations map[string]time.Duration, err error) {
+	var (
+		pipeline []*bson.Document
+		cursor   mongo.Cursor
+		stat     *common.JobDurationStat
+	)
+
+	durations = make(map[string]time.Duration)
+
+	//{$match: {isSkipped: {$ne: true}, startTime: {$gte: since}}}
+	//{$group: {_id: {namespace: {$ifNull: [namespace, "default"]}, jobName}, avgDuration: {$avg: {$subtract: [endTime, startTime]}}}}
+	//引入命名空间之前的日志没有namespace字段, 和default的日志合并统计
+	pipeline = []*bson.Document{
+		bson.NewDocument(bson.EC.SubDocument("$match", bson.NewDocument(
+			bson.EC.SubDocument("isSkipped", bson.NewDocument(bson.EC.Boolean("$ne", true))),
+			bson.EC.SubDocument("startTime", bson.NewDocument(bson.EC.Int64("$gte", since.UnixNano()/1000/1000))),
+		))),
+		bson.NewDocument(bson.EC.SubDocument("$group", bson.NewDocument(
+			bson.EC.SubDocument("_id", bson.NewDocument(
+				bson.EC.SubDocument("namespace", bson.NewDocument(
+					bson.EC.Array("$ifNull", bson.NewArray(bson.VC.String("$namespace"), bson.VC.String(common.JOB_DEFAULT_NAMESPACE))),
+				)),
+				bson.EC.String("jobName", "$jobName"),
+			)),
+			bson.EC.SubDocument("avgDuration", bson.NewDocument(
+				bson.EC.SubDocument("$avg", bson.NewDocument(
+					bson.EC.Array("$subtract", bson.NewArray(bson.VC.String("$endTime"), bson.VC.String("$startTime"))),
+				)),
+			)),
+		))),
+	}
+
+	if cursor, err = logMgr.logCollection.Aggregate(context.TODO(), pipeline); err != nil {
+		return
+	}
+	//延迟释放游标
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		stat = &common.JobDurationStat{}
+		if err = cursor.Decode(stat); err != nil {
+			continue
+		}
+		durations[common.BuildJobFullName(stat.Id.Namespace, stat.Id.JobName)] = time.Duration(stat.AvgDuration) * time.Millisecond
+	}
+	err = nil
+	return
+}
+
 //查看任务最近工作节点
 func (logMgr *LogMgr) ListRecentWorker(name string, skip int, limit int) (workerArr []string, err error) {
 	var (
@@ -86,7 +246,7 @@ func (logMgr *LogMgr) ListRecentWorker(name string, skip int, limit int) (worker
 		workerIP string
 	)
 
-	if logArr, err = G_logMgr.ListLog(name, skip, limit); err != nil {
+	if logArr, err = G_logMgr.ListLog(&common.JobLogQuery{Name: name}, skip, limit); err != nil {
 		return
 	}
 
@@ -2,6 +2,7 @@ package master
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -30,15 +31,15 @@ var (
 )
 
 //获取在线worker列表
-func (workerMgr *WorkerMgr) ListWorkers() (workerArr []string, err error) {
+func (workerMgr *WorkerMgr) ListWorkers() (workerArr []*common.WorkerInfo, err error) {
 	var (
-		getResp  *clientv3.GetResponse
-		kv       *mvccpb.KeyValue
-		workerIP string
+		getResp    *clientv3.GetResponse
+		kv         *mvccpb.KeyValue
+		workerInfo *common.WorkerInfo
 	)
 
 	//初始化数组
-	workerArr = make([]string, 0)
+	workerArr = make([]*common.WorkerInfo, 0)
 
 	//获取目录下所有Kv
 	if getResp, err = workerMgr.kv.Get(context.TODO(), common.JOB_WORKER_DIR, clientv3.WithPrefix()); err != nil {
@@ -48,8 +49,13 @@ func (workerMgr *WorkerMgr) ListWorkers() (workerArr []string, err error) {
 	//解析每个节点的IP
 	for _, kv = range getResp.Kvs {
 		// kv.Key : /cron/workers/192.168.1.2
-		workerIP = common.ExtractWorkerIP(string(kv.Key))
-		workerArr = append(workerArr, workerIP)
+		// kv.Value : {"ip": "192.168.1.2", "labels": {...}}, 老版本worker的值为空
+		workerInfo = &common.WorkerInfo{}
+		if len(kv.Value) != 0 && json.Unmarshal(kv.Value, workerInfo) != nil {
+			continue
+		}
+		workerInfo.IP = common.ExtractWorkerIP(string(kv.Key))
+		workerArr = append(workerArr, workerInfo)
 	}
 	return
 }
@@ -0,0 +1,242 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/gyyn/crontab/common"
+)
+
+//工作流管理器
+type WorkflowMgr struct {
+	client *clientv3.Client
+	kv     clientv3.KV
+	lease  clientv3.Lease
+}
+
+var (
+	//单例
+	G_workflowMgr *WorkflowMgr
+)
+
+//初始化
+func InitWorkflowMgr() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	//初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond,
+	}
+
+	//建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	//赋值单例
+	G_workflowMgr = &WorkflowMgr{
+		client: client,
+		kv:     clientv3.NewKV(client),
+		lease:  clientv3.NewLease(client),
+	}
+	return
+}
+
+//保存工作流
+func (workflowMgr *WorkflowMgr) SaveWorkflow(workflow *common.Workflow) (oldWorkflow *common.Workflow, err error) {
+	var (
+		workflowKey   string
+		workflowValue []byte
+		putResp       *clientv3.PutResponse
+		node          string
+	)
+
+	//校验DAG
+	common.NormalizeWorkflow(workflow)
+	if err = common.VerifyWorkflow(workflow); err != nil {
+		return
+	}
+
+	//节点引用的任务必须存在
+	for _, node = range workflow.Nodes {
+		if _, err = G_jobMgr.GetJob(node); err != nil {
+			if err == common.ERR_JOB_NOT_FOUND {
+				err = errors.New(common.ERR_WORKFLOW_JOB_NOT_FOUND.Error() + ": " + node)
+			}
+			return
+		}
+	}
+
+	//根节点的cron表达式
+	if workflow.CronExpr != "" {
+		if _, err = common.BuildWorkflowSchedulePlan(workflow); err != nil {
+			return
+		}
+	}
+
+	//etcd的保存key
+	workflowKey = common.JOB_WORKFLOW_DIR + workflow.Name
+	if workflowValue, err = json.Marshal(workflow); err != nil {
+		return
+	}
+
+	//保存到etcd
+	if putResp, err = workflowMgr.kv.Put(context.TODO(), workflowKey, string(workflowValue), clientv3.WithPrevKV()); err != nil {
+		return
+	}
+
+	//如果是更新，返回旧值
+	if putResp.PrevKv != nil {
+		if oldWorkflow, err = common.UnpackWorkflow(putResp.PrevKv.Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//删除工作流
+func (workflowMgr *WorkflowMgr) DeleteWorkflow(name string) (oldWorkflow *common.Workflow, err error) {
+	var (
+		delResp *clientv3.DeleteResponse
+	)
+
+	//从etcd中删除它
+	if delResp, err = workflowMgr.kv.Delete(context.TODO(), common.JOB_WORKFLOW_DIR+name, clientv3.WithPrevKV()); err != nil {
+		return
+	}
+
+	//返回被删除的工作流
+	if len(delResp.PrevKvs) != 0 {
+		if oldWorkflow, err = common.UnpackWorkflow(delResp.PrevKvs[0].Value); err != nil {
+			err = nil
+		}
+	}
+	return
+}
+
+//列举工作流
+func (workflowMgr *WorkflowMgr) ListWorkflows() (workflowList []*common.Workflow, err error) {
+	var (
+		getResp  *clientv3.GetResponse
+		kvPair   *mvccpb.KeyValue
+		workflow *common.Workflow
+	)
+
+	//获取目录下所有工作流
+	if getResp, err = workflowMgr.kv.Get(context.TODO(), common.JOB_WORKFLOW_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+
+	workflowList = make([]*common.Workflow, 0)
+	for _, kvPair = range getResp.Kvs {
+		if workflow, err = common.UnpackWorkflow(kvPair.Value); err != nil {
+			err = nil
+			continue
+		}
+		workflowList = append(workflowList, workflow)
+	}
+	return
+}
+
+//手动触发一次工作流
+func (workflowMgr *WorkflowMgr) TriggerWorkflow(name string) (workflowRun *common.WorkflowRun, err error) {
+	var (
+		getResp        *clientv3.GetResponse
+		workflow       *common.Workflow
+		now            time.Time
+		runValue       []byte
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		node           string
+	)
+
+	//读取工作流定义
+	if getResp, err = workflowMgr.kv.Get(context.TODO(), common.JOB_WORKFLOW_DIR+name); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_WORKFLOW_NOT_FOUND
+		return
+	}
+	if workflow, err = common.UnpackWorkflow(getResp.Kvs[0].Value); err != nil {
+		return
+	}
+
+	//手动触发的运行ID带纳秒, 避免与cron触发冲突
+	now = time.Now()
+	workflowRun = common.BuildWorkflowRun(workflow, workflow.Name+"-manual-"+strconv.FormatInt(now.UnixNano(), 10), now)
+	if runValue, err = json.Marshal(workflowRun); err != nil {
+		return
+	}
+
+	//运行记录带租约, 到期自动清理
+	if leaseGrantResp, err = workflowMgr.lease.Grant(context.TODO(), common.JOB_WORKFLOW_RUN_TTL); err != nil {
+		return
+	}
+	if _, err = workflowMgr.kv.Put(context.TODO(), common.BuildWorkflowRunKey(workflow.Name, workflowRun.RunId), string(runValue), clientv3.WithLease(leaseGrantResp.ID)); err != nil {
+		return
+	}
+
+	//通过/cron/once触发根节点
+	for _, node = range common.BuildWorkflowRoots(workflow) {
+		if err = common.OnceWorkflowNode(workflowMgr.kv, workflowMgr.lease, workflowRun, node); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//列举工作流的运行记录
+func (workflowMgr *WorkflowMgr) ListWorkflowRuns(name string) (runList []*common.WorkflowRun, err error) {
+	var (
+		getResp     *clientv3.GetResponse
+		kvPair      *mvccpb.KeyValue
+		workflowRun *common.WorkflowRun
+	)
+
+	//按创建顺序倒排, 最新的在前
+	if getResp, err = workflowMgr.kv.Get(context.TODO(), common.JOB_WORKFLOW_RUN_DIR+name+"/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortDescend)); err != nil {
+		return
+	}
+
+	runList = make([]*common.WorkflowRun, 0)
+	for _, kvPair = range getResp.Kvs {
+		workflowRun = &common.WorkflowRun{}
+		if err = json.Unmarshal(kvPair.Value, workflowRun); err != nil {
+			err = nil
+			continue
+		}
+		runList = append(runList, workflowRun)
+	}
+	return
+}
+
+//查看一次工作流运行
+func (workflowMgr *WorkflowMgr) GetWorkflowRun(name string, runId string) (workflowRun *common.WorkflowRun, err error) {
+	var (
+		getResp *clientv3.GetResponse
+	)
+
+	if getResp, err = workflowMgr.kv.Get(context.TODO(), common.BuildWorkflowRunKey(name, runId)); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_WORKFLOW_RUN_NOT_FOUND
+		return
+	}
+
+	workflowRun = &common.WorkflowRun{}
+	if err = json.Unmarshal(getResp.Kvs[0].Value, workflowRun); err != nil {
+		workflowRun = nil
+	}
+	return
+}
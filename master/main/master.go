@@ -56,6 +56,21 @@ func main() {
 		goto ERR
 	}
 
+	//工作流管理器
+	if err = master.InitWorkflowMgr(); err != nil {
+		goto ERR
+	}
+
+	//日历管理器
+	if err = master.InitCalendarMgr(); err != nil {
+		goto ERR
+	}
+
+	//集群冻结管理器
+	if err = master.InitFreezeMgr(); err != nil {
+		goto ERR
+	}
+
 	//启动api http服务
 	if err = master.InitApiServer(); err != nil {
 		goto ERR
@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gyyn/crontab/common"
+)
+
+//CPU配额的统计周期, 单位微秒
+const cgroupCpuPeriod = 100000
+
+//一次执行对应的cgroup v2子目录
+type JobCgroup struct {
+	path string
+	fd   *os.File
+}
+
+//准备cgroup父目录, 并为子cgroup开启cpu/memory/pids控制器
+func InitCgroup() (err error) {
+	if G_config.CgroupParent == "" {
+		return
+	}
+
+	if err = os.MkdirAll(G_config.CgroupParent, 0755); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(G_config.CgroupParent, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+	return
+}
+
+//本机能否执行任务: 有资源限制的任务需要配置了cgroupParent, 用于抢锁前过滤
+func checkCgroup(job *common.Job) (err error) {
+	if job.Resources.IsLimited() && G_config.CgroupParent == "" {
+		err = common.ERR_CGROUP_DISABLED
+	}
+	return
+}
+
+//为一次执行创建子cgroup并写入资源限制, 未配置cgroupParent时返回nil
+func CreateJobCgroup(info *common.JobExecuteInfo, attempt int) (jobCgroup *JobCgroup, err error) {
+	var (
+		resources *common.JobResources
+		name      string
+		path      string
+	)
+
+	resources = &info.Job.Resources
+	if G_config.CgroupParent == "" {
+		if resources.IsLimited() {
+			err = common.ERR_CGROUP_DISABLED
+		}
+		return
+	}
+
+	//runId中的/替换掉, 再加上尝试次数和时间戳保证唯一
+	name = strings.Replace(info.RunId, "/", "_", -1) + "-" + strconv.Itoa(attempt) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	path = filepath.Join(G_config.CgroupParent, name)
+	if err = os.Mkdir(path, 0755); err != nil {
+		return
+	}
+	jobCgroup = &JobCgroup{path: path}
+
+	if resources.MemoryMax != 0 {
+		if err = jobCgroup.write("memory.max", strconv.FormatInt(resources.MemoryMax, 10)); err != nil {
+			goto ERR
+		}
+	}
+	if resources.CpuQuota != 0 {
+		if err = jobCgroup.write("cpu.max", strconv.FormatInt(int64(resources.CpuQuota*cgroupCpuPeriod), 10)+" "+strconv.Itoa(cgroupCpuPeriod)); err != nil {
+			goto ERR
+		}
+	}
+	if resources.PidsMax != 0 {
+		if err = jobCgroup.write("pids.max", strconv.FormatInt(resources.PidsMax, 10)); err != nil {
+			goto ERR
+		}
+	}
+
+	//进程通过clone3直接创建在该cgroup中, 不存在先启动再迁移的窗口
+	if jobCgroup.fd, err = os.Open(path); err != nil {
+		goto ERR
+	}
+	return
+ERR:
+	jobCgroup.Remove()
+	jobCgroup = nil
+	return
+}
+
+//写cgroup接口文件
+func (jobCgroup *JobCgroup) write(file string, value string) (err error) {
+	return ioutil.WriteFile(filepath.Join(jobCgroup.path, file), []byte(value), 0644)
+}
+
+//设置进程属性, 让命令启动在该cgroup中
+func (jobCgroup *JobCgroup) Apply(sysProcAttr *syscall.SysProcAttr) {
+	sysProcAttr.UseCgroupFD = true
+	sysProcAttr.CgroupFD = int(jobCgroup.fd.Fd())
+}
+
+//是否发生过OOM kill
+func (jobCgroup *JobCgroup) IsOOMKilled() (oomKilled bool) {
+	var (
+		file    *os.File
+		scanner *bufio.Scanner
+		fields  []string
+		err     error
+	)
+
+	if file, err = os.Open(filepath.Join(jobCgroup.path, "memory.events")); err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields = strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "oom_kill" {
+			oomKilled = fields[1] != "0"
+			return
+		}
+	}
+	return
+}
+
+//杀死cgroup中残留的进程并删除目录
+func (jobCgroup *JobCgroup) Remove() {
+	var (
+		i   int
+		err error
+	)
+
+	if jobCgroup.fd != nil {
+		jobCgroup.fd.Close()
+	}
+	jobCgroup.write("cgroup.kill", "1")
+
+	//进程退出需要一点时间, 删除失败时稍后重试
+	for i = 0; i < 10; i++ {
+		if err = os.Remove(jobCgroup.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"syscall"
+
+	"github.com/gyyn/crontab/common"
+)
+
+//cgroup只在linux上支持, 其他平台不能执行有资源限制的任务
+type JobCgroup struct {
+}
+
+//其他平台不能配置cgroupParent
+func InitCgroup() (err error) {
+	if G_config.CgroupParent != "" {
+		err = common.ERR_CGROUP_UNSUPPORTED
+	}
+	return
+}
+
+//本机能否执行任务: 有资源限制的任务都不能执行
+func checkCgroup(job *common.Job) (err error) {
+	if job.Resources.IsLimited() {
+		err = common.ERR_CGROUP_DISABLED
+	}
+	return
+}
+
+//有资源限制的任务直接拒绝, 否则返回nil
+func CreateJobCgroup(info *common.JobExecuteInfo, attempt int) (jobCgroup *JobCgroup, err error) {
+	err = checkCgroup(info.Job)
+	return
+}
+
+func (jobCgroup *JobCgroup) Apply(sysProcAttr *syscall.SysProcAttr) {
+}
+
+func (jobCgroup *JobCgroup) IsOOMKilled() (oomKilled bool) {
+	return
+}
+
+func (jobCgroup *JobCgroup) Remove() {
+}
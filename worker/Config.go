@@ -4,16 +4,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+
+	"github.com/gyyn/crontab/common"
 )
 
 //程序配置
 type Config struct {
-	EtcdEndpoints         []string `json:"etcdEndpoints"`
-	EtcdDialTimeout       int      `json:"etcdDialTimeout"`
-	MongodbUri            string   `json:"mongodbUri"`
-	MongodbConnectTimeout int      `json:"mongodbConnectTimeout"`
-	JobLogBatchSize       int      `json:"jobLogBatchSize"`
-	JobLogCommitTimeout   int      `json"jobLogCommitTimeout"`
+	EtcdEndpoints         []string          `json:"etcdEndpoints"`
+	EtcdDialTimeout       int               `json:"etcdDialTimeout"`
+	MongodbUri            string            `json:"mongodbUri"`
+	MongodbConnectTimeout int               `json:"mongodbConnectTimeout"`
+	JobLogBatchSize       int               `json:"jobLogBatchSize"`
+	JobLogCommitTimeout   int               `json:"jobLogCommitTimeout"`
+	Labels                map[string]string `json:"labels"`
+	RunAsUsers            []string          `json:"runAsUsers"`
+	RunAsGroups           []string          `json:"runAsGroups"`
+	DefaultRunAsUser      string            `json:"defaultRunAsUser"`
+	CgroupParent          string            `json:"cgroupParent"`
+	LogLockConflict       bool              `json:"logLockConflict"`
+	OutputHeadBytes       int               `json:"outputHeadBytes"`
+	OutputTailBytes       int               `json:"outputTailBytes"`
 }
 
 var (
@@ -38,6 +49,12 @@ func InitConfig(filename string) (err error) {
 		return
 	}
 
+	//root运行时必须指定任务的默认运行用户, 避免未设置runAsUser的任务以root执行
+	if os.Geteuid() == 0 && conf.DefaultRunAsUser == "" {
+		err = common.ERR_DEFAULT_RUN_AS_USER_REQUIRED
+		return
+	}
+
 	//3, 赋值单例
 	G_config = &conf
 
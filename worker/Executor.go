@@ -1,8 +1,13 @@
 package worker
 
 import (
+	"context"
 	"math/rand"
+	"os"
 	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gyyn/crontab/common"
@@ -10,61 +15,364 @@ import (
 
 //任务执行器
 type Executor struct {
+	lock           sync.Mutex
+	running        sync.WaitGroup     //正在执行的命令
+	shuttingDown   bool               //worker正在退出, 不再启动新命令
+	shutdownCtx    context.Context    //worker退出时取消, 终止所有正在执行的命令
+	shutdownCancel context.CancelFunc //取消shutdownCtx
 }
 
 var (
 	G_executor *Executor
 )
 
+//执行一次shell命令
+func (executor *Executor) runCommand(info *common.JobExecuteInfo, attempt int) (result *common.JobExecuteResult) {
+	var (
+		cmd       *exec.Cmd
+		err       error
+		stdout    *boundedCapture
+		stderr    *boundedCapture
+		headLimit int
+		tailLimit int
+		exitError *exec.ExitError
+		isExit    bool
+		attr      *syscall.SysProcAttr
+		runAsEnv  []string
+		jobCgroup *JobCgroup
+		signal    syscall.Signal
+		status    syscall.WaitStatus
+		cmdCtx    context.Context
+		cmdCancel context.CancelFunc
+	)
+
+	result = &common.JobExecuteResult{
+		ExecuteInfo: info,
+		Attempt:     attempt,
+		StartTime:   time.Now(),
+	}
+
+	//worker正在退出, 不再启动新命令
+	if !executor.beginCommand() {
+		result.EndTime = time.Now()
+		result.Err = common.ERR_WORKER_SHUTDOWN
+		result.ExitCode = -1
+		result.IsRejected = true
+		return
+	}
+	defer executor.running.Done()
+
+	//切换到任务指定的运行用户, 不允许时直接拒绝
+	if attr, runAsEnv, err = buildRunAsAttr(info.Job); err != nil {
+		result.EndTime = time.Now()
+		result.Err = err
+		result.ExitCode = -1
+		result.IsRejected = true
+		return
+	}
+
+	//每次执行放到独立的cgroup中, 应用资源限制
+	if jobCgroup, err = CreateJobCgroup(info, attempt); err != nil {
+		result.EndTime = time.Now()
+		result.Err = err
+		result.ExitCode = -1
+		result.IsRejected = true
+		return
+	}
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	if jobCgroup != nil {
+		defer jobCgroup.Remove()
+		jobCgroup.Apply(attr)
+	}
+
+	//放到独立的进程组中, 终止时连同子孙进程一起杀掉
+	setProcessGroup(attr)
+
+	//执行shell命令
+	cmd = exec.Command("/bin/bash", "-c", info.Job.Command)
+	cmd.Env = append(os.Environ(), "CRON_RUN_ID="+info.RunId)
+	cmd.Env = append(cmd.Env, runAsEnv...)
+	cmd.SysProcAttr = attr
+	if info.Job.ExecuteMode == common.EXECUTE_MODE_SHARD {
+		cmd.Env = append(cmd.Env,
+			"CRON_SHARD_INDEX="+strconv.Itoa(info.ShardIndex),
+			"CRON_SHARD_TOTAL="+strconv.Itoa(info.Job.ShardTotal))
+	}
+
+	//执行并捕获输出
+	//边执行边捕获, 只保留开头和结尾
+	headLimit, tailLimit = buildOutputLimit(info.Job)
+	stdout = newBoundedCapture(headLimit, tailLimit)
+	stderr = newBoundedCapture(headLimit, tailLimit)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmdCtx, cmdCancel = common.BuildCommandContext(info)
+	defer cmdCancel()
+	if err = cmd.Start(); err == nil {
+		signal, err = executor.waitCommand(cmdCtx, info, cmd)
+	}
+
+	//记录任务结束时间
+	result.EndTime = time.Now()
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	result.StdoutBytes = stdout.total
+	result.StderrBytes = stderr.total
+	result.Truncated = stdout.Truncated() || stderr.Truncated()
+	result.Err = err
+
+	//记录退出码, 没能正常退出的记为-1
+	if err != nil {
+		if exitError, isExit = err.(*exec.ExitError); isExit {
+			result.ExitCode = exitError.ExitCode()
+			if status, isExit = exitError.Sys().(syscall.WaitStatus); isExit && status.Signaled() && signal == 0 {
+				signal = status.Signal()
+			}
+		} else {
+			result.ExitCode = -1
+		}
+	}
+
+	//记录结束任务的信号, 优先记录worker发出的信号
+	if signal != 0 {
+		result.Signal = signalName(signal)
+	}
+
+	//超出内存限制被OOM杀死, 与普通错误区分开
+	if jobCgroup != nil && jobCgroup.IsOOMKilled() {
+		result.IsOOM = true
+		result.Err = common.ERR_JOB_OOM
+	}
+
+	//超时被终止, 与普通错误区分开
+	if cmdCtx.Err() == context.DeadlineExceeded {
+		result.IsTimeout = true
+		result.Err = common.ERR_JOB_TIMEOUT
+	}
+
+	//被强杀或替换
+	if info.CancelCtx.Err() == context.Canceled {
+		result.IsKilled = true
+	}
+
+	//worker退出时被终止, 不再重试
+	if info.CancelCtx.Err() == nil && executor.shutdownCtx.Err() != nil {
+		result.IsRejected = true
+		result.IsKilled = true
+		result.Err = common.ERR_WORKER_SHUTDOWN
+	}
+	return
+}
+
+//登记一个要启动的命令, worker正在退出时返回false
+func (executor *Executor) beginCommand() bool {
+	executor.lock.Lock()
+	defer executor.lock.Unlock()
+
+	if executor.shuttingDown {
+		return false
+	}
+	executor.running.Add(1)
+	return true
+}
+
+//worker是否正在退出
+func (executor *Executor) isShuttingDown() bool {
+	executor.lock.Lock()
+	defer executor.lock.Unlock()
+
+	return executor.shuttingDown
+}
+
+//等待命令结束, 被强杀、超时或worker退出时先SIGTERM整个进程组, 超过宽限期再SIGKILL
+//返回worker发出的最后一个信号, 命令自行结束时为0
+func (executor *Executor) waitCommand(cmdCtx context.Context, info *common.JobExecuteInfo, cmd *exec.Cmd) (signal syscall.Signal, err error) {
+	var (
+		waitChan chan error
+	)
+
+	waitChan = make(chan error, 1)
+	go func() {
+		waitChan <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitChan:
+		return
+	case <-cmdCtx.Done():
+	case <-executor.shutdownCtx.Done():
+	}
+
+	//先让任务有机会清理
+	signal = syscall.SIGTERM
+	killProcessGroup(cmd, syscall.SIGTERM)
+	select {
+	case err = <-waitChan:
+		return
+	case <-time.After(common.BuildKillGracePeriod(info.Job)):
+	}
+
+	//宽限期已过, 强制杀死整个进程组
+	signal = syscall.SIGKILL
+	killProcessGroup(cmd, syscall.SIGKILL)
+	err = <-waitChan
+	return
+}
+
+//worker退出: 终止所有正在执行的命令, 并等待它们结束
+func (executor *Executor) Shutdown() {
+	executor.lock.Lock()
+	executor.shuttingDown = true
+	executor.shutdownCancel()
+	executor.lock.Unlock()
+
+	executor.running.Wait()
+}
+
+//按并发策略和执行模式抢锁
+//allow: 锁只保证同一次调度(运行ID)不被多个worker重复执行, 不同调度可以重叠
+//broadcast: 每个worker各用一把锁, 都会执行
+//shard: 每个分片一把锁, 每个worker按随机顺序抢一个本次调度还没执行完的分片
+func (executor *Executor) lockJob(info *common.JobExecuteInfo) (jobLock *JobLock, err error) {
+	var (
+		lockName   string
+		shardIndex int
+		done       bool
+	)
+
+	lockName = common.BuildJobFullName(info.Job.Namespace, info.Job.Name)
+	if info.Job.ConcurrencyPolicy == common.CONCURRENCY_POLICY_ALLOW {
+		lockName = info.RunId
+	}
+
+	switch info.Job.ExecuteMode {
+	case common.EXECUTE_MODE_BROADCAST:
+		jobLock = G_jobMgr.CreateJobLock(lockName + "/" + G_register.localIP)
+		err = jobLock.TryLock()
+	case common.EXECUTE_MODE_SHARD:
+		for _, shardIndex = range rand.Perm(info.Job.ShardTotal) {
+			jobLock = G_jobMgr.CreateJobLock(lockName + "/shard-" + strconv.Itoa(shardIndex))
+			if err = jobLock.TryLock(); err != nil {
+				continue
+			}
+			//执行完的分片先记录再释放锁, 抢到锁后再检查就不会重复执行
+			if done, err = G_jobMgr.IsShardDone(info.RunId, shardIndex); err == nil && !done {
+				info.ShardIndex = shardIndex
+				return
+			}
+			jobLock.Unlock()
+			jobLock = nil
+			err = common.ERR_LOCK_ALREADY_REQUIRED
+		}
+		if err == nil { //分片数为0
+			err = common.ERR_LOCK_ALREADY_REQUIRED
+		}
+	default:
+		jobLock = G_jobMgr.CreateJobLock(lockName)
+		err = jobLock.TryLock()
+	}
+	return
+}
+
 //执行一个任务
 func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) {
 	go func() {
 		var (
-			cmd     *exec.Cmd
-			err     error
-			output  []byte
-			result  *common.JobExecuteResult
-			jobLock *JobLock
+			err       error
+			result    *common.JobExecuteResult
+			jobLock   *JobLock
+			attempt   int
+			delay     time.Duration
+			willRetry bool
 		)
 
 		//任务结果
 		result = &common.JobExecuteResult{
 			ExecuteInfo: info,
-			Output:      make([]byte, 0),
+			Attempt:     1,
 		}
 
-		//初始化分布式锁
-		jobLock = G_jobMgr.CreateJobLock(info.Job.Name)
+		//执行结束并释放锁后通知等待者
+		defer close(info.Done)
+
+		//replace策略: 等待被替换的旧执行退出并释放锁
+		if info.Replaces != nil {
+			<-info.Replaces.Done
+		}
 
 		//记录任务开始时间
 		result.StartTime = time.Now()
 
+		//worker正在退出, 不再抢锁, 留给其他worker执行
+		if executor.isShuttingDown() {
+			result.Err = common.ERR_WORKER_STOPPING
+			result.ExitCode = -1
+			result.IsRejected = true
+			result.EndTime = time.Now()
+			G_scheduler.PushJobResult(result)
+			return
+		}
+
 		//上锁
 		//随机睡眠(0~1s)
 		time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
 
-		err = jobLock.TryLock()
+		jobLock, err = executor.lockJob(info)
 		//defer 函数执行后调用
-		defer jobLock.Unlock()
+		if jobLock != nil {
+			defer jobLock.Unlock()
+		}
 
 		if err != nil { //上锁失败
 			result.Err = err
+			result.ExitCode = -1
 			result.EndTime = time.Now()
-		} else {
-			//上锁成功后，重置任务启动时间
-			result.StartTime = time.Now()
+			G_scheduler.PushJobResult(result)
+			return
+		}
 
-			//执行shell命令
-			cmd = exec.CommandContext(info.CancelCtx, "/bin/bash", "-c", info.Job.Command)
+		//工作流节点由抢到锁的worker记录开始执行
+		if info.Trigger != nil {
+			G_workflowMgr.ReportNodeStart(info.Trigger, common.BuildJobFullName(info.Job.Namespace, info.Job.Name), G_register.localIP)
+		}
 
-			//执行并捕获输出
-			output, err = cmd.CombinedOutput()
+		//上锁成功后执行, 失败重试期间一直持有锁
+		for attempt = 1; ; attempt++ {
+			result = executor.runCommand(info, attempt)
 
-			//记录任务结束时间
-			result.EndTime = time.Now()
-			result.Output = output
-			result.Err = err
+			if delay, willRetry = common.BuildRetryDelay(info.Job, result); !willRetry {
+				break
+			}
+
+			//本次尝试的结果先回传, Scheduler不会删除执行记录
+			result.WillRetry = true
+			G_scheduler.PushJobResult(result)
+
+			//等待退避时间, 期间可被强杀取消
+			select {
+			case <-time.After(delay):
+				continue
+			case <-info.CancelCtx.Done():
+				result = &common.JobExecuteResult{
+					ExecuteInfo: info,
+					Attempt:     attempt + 1,
+					Err:         common.ERR_JOB_RETRY_CANCELED,
+					IsKilled:    true,
+					ExitCode:    -1,
+					StartTime:   time.Now(),
+					EndTime:     time.Now(),
+				}
+			}
+			break
 		}
+
+		//分片执行完, 释放锁之前记录下来, 其他worker不会再抢这个分片
+		if info.Job.ExecuteMode == common.EXECUTE_MODE_SHARD && result.Err != common.ERR_WORKER_SHUTDOWN {
+			G_jobMgr.MarkShardDone(info.RunId, info.ShardIndex)
+		}
+
 		//任务执行完成后，把执行的结果返回给Scheduler，Scheduler会从executingTable中删除掉执行记录
 		G_scheduler.PushJobResult(result)
 	}()
@@ -73,5 +381,6 @@ func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) {
 //初始化执行器
 func InitExecutor() (err error) {
 	G_executor = &Executor{}
+	G_executor.shutdownCtx, G_executor.shutdownCancel = context.WithCancel(context.TODO())
 	return
 }
@@ -2,6 +2,8 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
@@ -34,8 +36,14 @@ func (jobMgr *JobMgr) watchJobs() (err error) {
 		watchEvent         *clientv3.Event
 		jobName            string
 		jobEvent           *common.JobEvent
+		lastPlanTimes      map[string]time.Time
 	)
 
+	//加载各任务最近一次执行过的计划时间, 用于计算停机期间错过的调度
+	if lastPlanTimes, err = jobMgr.loadLastPlanTimes(); err != nil {
+		return
+	}
+
 	// 1, get一下/cron/jobs/目录下的所有任务，并且获知当前集群的revision
 	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_SAVE_DIR, clientv3.WithPrefix()); err != nil {
 		return
@@ -46,6 +54,7 @@ func (jobMgr *JobMgr) watchJobs() (err error) {
 		// 反序列化json得到Job
 		if job, err = common.UnpackJob(kvpair.Value); err == nil {
 			jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
+			jobEvent.LastPlanTime = lastPlanTimes[common.BuildJobFullName(job.Namespace, job.Name)]
 			// 同步给scheduler(调度协程)
 			G_scheduler.PushJobEvent(jobEvent)
 		}
@@ -68,10 +77,11 @@ func (jobMgr *JobMgr) watchJobs() (err error) {
 					//构建一个更新Event
 					jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
 				case mvccpb.DELETE: // 任务被删除了
-					//Delete /cron/jobs/job10
+					//Delete /cron/jobs/default/job10
 					jobName = common.ExtractJobName(string(watchEvent.Kv.Key))
 
-					job = &common.Job{Name: jobName}
+					job = &common.Job{}
+					job.Namespace, job.Name = common.ExtractJobNamespace(jobName)
 
 					//构建一个删除Event
 					jobEvent = common.BuildJobEvent(common.JOB_EVENT_DELETE, job)
@@ -84,6 +94,98 @@ func (jobMgr *JobMgr) watchJobs() (err error) {
 	return
 }
 
+//监听日历变化
+func (jobMgr *JobMgr) watchCalendars() (err error) {
+	var (
+		getResp            *clientv3.GetResponse
+		kvpair             *mvccpb.KeyValue
+		calendar           *common.Calendar
+		watchStartRevision int64
+		watchChan          clientv3.WatchChan
+		watchResp          clientv3.WatchResponse
+		watchEvent         *clientv3.Event
+		jobEvent           *common.JobEvent
+	)
+
+	//get一下/cron/calendars/目录下的所有日历
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_CALENDAR_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+
+	for _, kvpair = range getResp.Kvs {
+		if calendar, err = common.UnpackCalendar(kvpair.Value); err == nil {
+			G_scheduler.PushJobEvent(common.BuildCalendarEvent(common.JOB_EVENT_CALENDAR_SAVE, calendar))
+		}
+	}
+
+	//从该revision向后监听变化事件
+	go func() {
+		watchStartRevision = getResp.Header.Revision + 1
+		watchChan = jobMgr.watcher.Watch(context.TODO(), common.JOB_CALENDAR_DIR, clientv3.WithRev(watchStartRevision), clientv3.WithPrefix())
+		for watchResp = range watchChan {
+			for _, watchEvent = range watchResp.Events {
+				switch watchEvent.Type {
+				case mvccpb.PUT: //日历保存事件
+					if calendar, err = common.UnpackCalendar(watchEvent.Kv.Value); err != nil {
+						continue
+					}
+					jobEvent = common.BuildCalendarEvent(common.JOB_EVENT_CALENDAR_SAVE, calendar)
+				case mvccpb.DELETE: //日历被删除了
+					calendar = &common.Calendar{Name: common.ExtractCalendarName(string(watchEvent.Kv.Key))}
+					jobEvent = common.BuildCalendarEvent(common.JOB_EVENT_CALENDAR_DELETE, calendar)
+				}
+				G_scheduler.PushJobEvent(jobEvent)
+			}
+		}
+	}()
+	return
+}
+
+//监听集群冻结
+func (jobMgr *JobMgr) watchFreeze() (err error) {
+	var (
+		getResp            *clientv3.GetResponse
+		freeze             *common.Freeze
+		watchStartRevision int64
+		watchChan          clientv3.WatchChan
+		watchResp          clientv3.WatchResponse
+		watchEvent         *clientv3.Event
+		jobEvent           *common.JobEvent
+	)
+
+	//get一下当前的冻结
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_FREEZE_KEY); err != nil {
+		return
+	}
+
+	if len(getResp.Kvs) != 0 {
+		if freeze, err = common.UnpackFreeze(getResp.Kvs[0].Value); err == nil {
+			G_scheduler.PushJobEvent(common.BuildFreezeEvent(common.JOB_EVENT_FREEZE_SAVE, freeze))
+		}
+	}
+
+	//从该revision向后监听变化事件
+	go func() {
+		watchStartRevision = getResp.Header.Revision + 1
+		watchChan = jobMgr.watcher.Watch(context.TODO(), common.JOB_FREEZE_KEY, clientv3.WithRev(watchStartRevision))
+		for watchResp = range watchChan {
+			for _, watchEvent = range watchResp.Events {
+				switch watchEvent.Type {
+				case mvccpb.PUT: //设置冻结
+					if freeze, err = common.UnpackFreeze(watchEvent.Kv.Value); err != nil {
+						continue
+					}
+					jobEvent = common.BuildFreezeEvent(common.JOB_EVENT_FREEZE_SAVE, freeze)
+				case mvccpb.DELETE: //解除冻结或到期
+					jobEvent = common.BuildFreezeEvent(common.JOB_EVENT_FREEZE_CLEAR, nil)
+				}
+				G_scheduler.PushJobEvent(jobEvent)
+			}
+		}
+	}()
+	return
+}
+
 //监听强杀任务通知
 func (jobMgr *JobMgr) watchKiller() {
 	var (
@@ -104,7 +206,8 @@ func (jobMgr *JobMgr) watchKiller() {
 				switch watchEvent.Type {
 				case mvccpb.PUT: //杀死任务事件
 					jobName = common.ExtractKillerName(string(watchEvent.Kv.Key))
-					job = &common.Job{Name: jobName}
+					job = &common.Job{}
+					job.Namespace, job.Name = common.ExtractJobNamespace(jobName)
 					jobEvent = common.BuildJobEvent(common.JOB_EVENT_KILL, job)
 					//事件推给scheduler
 					G_scheduler.PushJobEvent(jobEvent)
@@ -118,6 +221,7 @@ func (jobMgr *JobMgr) watchKiller() {
 //监听立即执行任务通知
 func (jobMgr *JobMgr) watchOnce() {
 	var (
+		err        error
 		watchChan  clientv3.WatchChan
 		watchResp  clientv3.WatchResponse
 		watchEvent *clientv3.Event
@@ -135,8 +239,14 @@ func (jobMgr *JobMgr) watchOnce() {
 				switch watchEvent.Type {
 				case mvccpb.PUT: //立即执行任务事件
 					jobName = common.ExtractOnceName(string(watchEvent.Kv.Key))
-					job = &common.Job{Name: jobName}
+					job = &common.Job{}
+					job.Namespace, job.Name = common.ExtractJobNamespace(jobName)
 					jobEvent = common.BuildJobEvent(common.JOB_EVENT_ONCE, job)
+					jobEvent.OnceId = strconv.FormatInt(watchEvent.Kv.ModRevision, 10)
+					//工作流触发的立即执行, 值里带着工作流运行信息
+					if jobEvent.Trigger, err = common.UnpackWorkflowTrigger(watchEvent.Kv.Value); err != nil {
+						continue
+					}
 					//事件推给scheduler
 					G_scheduler.PushJobEvent(jobEvent)
 				case mvccpb.DELETE: //once标记过期, 被自动删除
@@ -146,6 +256,218 @@ func (jobMgr *JobMgr) watchOnce() {
 	}()
 }
 
+//at类型的任务执行成功后, 标记为已完成或删除掉, jobName为命名空间/任务名
+//和master修改任务一样记录历史版本, 可以回滚
+func (jobMgr *JobMgr) CompleteJob(jobName string) (err error) {
+	var (
+		jobKey     string
+		getResp    *clientv3.GetResponse
+		modRev     int64
+		oldJob     *common.Job
+		job        *common.Job
+		jobValue   []byte
+		op         clientv3.Op
+		jobRev     *common.JobRevision
+		revision   int
+		historyKey string
+		history    []byte
+		txnResp    *clientv3.TxnResponse
+	)
+
+	jobKey = common.JOB_SAVE_DIR + jobName
+	if getResp, err = jobMgr.kv.Get(context.TODO(), jobKey); err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		return
+	}
+	modRev = getResp.Kvs[0].ModRevision
+	if oldJob, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil || oldJob.Completed {
+		return
+	}
+	if job, err = common.UnpackJob(getResp.Kvs[0].Value); err != nil {
+		return
+	}
+
+	jobRev = &common.JobRevision{
+		Namespace: job.Namespace,
+		Name:      job.Name,
+		Author:    "worker:" + G_register.localIP,
+	}
+	if job.DeleteAfterRun {
+		op = clientv3.OpDelete(jobKey)
+		jobRev.Action = common.JOB_ACTION_DELETE
+		jobRev.Diff = common.BuildJobDiff(oldJob, nil)
+	} else {
+		job.Completed = true
+		job.CompletedAt = time.Now().Format("2006-01-02 15:04:05")
+		if jobValue, err = json.Marshal(job); err != nil {
+			return
+		}
+		op = clientv3.OpPut(jobKey, string(jobValue))
+		jobRev.Action = common.JOB_ACTION_SAVE
+		jobRev.Job = job
+		jobRev.Diff = common.BuildJobDiff(oldJob, job)
+	}
+
+	//任务和历史版本在同一个事务里写入, 历史版本号冲突时重试
+	for {
+		if revision, err = common.LastJobRevision(jobMgr.kv, jobName); err != nil {
+			return
+		}
+		revision++
+		historyKey = common.BuildJobHistoryKey(jobName, revision)
+		jobRev.Revision = revision
+		jobRev.Time = time.Now().Format("2006-01-02 15:04:05")
+		if history, err = json.Marshal(jobRev); err != nil {
+			return
+		}
+
+		if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", modRev),
+				clientv3.Compare(clientv3.CreateRevision(historyKey), "=", 0)).
+			Then(op, clientv3.OpPut(historyKey, string(history))).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			break
+		}
+
+		//任务在此期间被修改过就放弃, 以新的定义为准
+		if getResp, err = jobMgr.kv.Get(context.TODO(), jobKey); err != nil {
+			return
+		}
+		if len(getResp.Kvs) == 0 || getResp.Kvs[0].ModRevision != modRev {
+			return
+		}
+	}
+
+	common.PruneJobHistory(jobMgr.kv, jobName, revision)
+	return
+}
+
+//加载所有任务最近一次执行过的计划时间
+func (jobMgr *JobMgr) loadLastPlanTimes() (lastPlanTimes map[string]time.Time, err error) {
+	var (
+		getResp  *clientv3.GetResponse
+		kvpair   *mvccpb.KeyValue
+		planTime int64
+	)
+
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_LAST_RUN_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+
+	lastPlanTimes = make(map[string]time.Time)
+	for _, kvpair = range getResp.Kvs {
+		if planTime, err = strconv.ParseInt(string(kvpair.Value), 10, 64); err != nil {
+			err = nil
+			continue
+		}
+		lastPlanTimes[common.ExtractLastRunName(string(kvpair.Key))] = time.Unix(0, planTime*1000*1000)
+	}
+	return
+}
+
+//保存任务最近一次执行过的计划时间(毫秒), 只会往后推进, jobName为命名空间/任务名
+func (jobMgr *JobMgr) SaveLastPlanTime(jobName string, planTime time.Time) (err error) {
+	var (
+		lastRunKey   string
+		planTimeMs   int64
+		getResp      *clientv3.GetResponse
+		lastPlanTime int64
+		txnResp      *clientv3.TxnResponse
+	)
+
+	lastRunKey = common.JOB_LAST_RUN_DIR + jobName
+	planTimeMs = planTime.UnixNano() / 1000 / 1000
+
+	//乐观锁更新, 冲突时重新读取
+	for {
+		if getResp, err = jobMgr.kv.Get(context.TODO(), lastRunKey); err != nil {
+			return
+		}
+
+		//不存在则直接创建
+		if len(getResp.Kvs) == 0 {
+			if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+				If(clientv3.Compare(clientv3.CreateRevision(lastRunKey), "=", 0)).
+				Then(clientv3.OpPut(lastRunKey, strconv.FormatInt(planTimeMs, 10))).
+				Commit(); err != nil {
+				return
+			}
+		} else {
+			//已记录的时间更晚, 无需更新
+			if lastPlanTime, err = strconv.ParseInt(string(getResp.Kvs[0].Value), 10, 64); err == nil && lastPlanTime >= planTimeMs {
+				return
+			}
+			if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+				If(clientv3.Compare(clientv3.ModRevision(lastRunKey), "=", getResp.Kvs[0].ModRevision)).
+				Then(clientv3.OpPut(lastRunKey, strconv.FormatInt(planTimeMs, 10))).
+				Commit(); err != nil {
+				return
+			}
+		}
+
+		if txnResp.Succeeded {
+			return
+		}
+	}
+}
+
+//认领一次调度的跳过日志, 只有第一个认领的worker返回true
+func (jobMgr *JobMgr) ClaimSkipLog(runId string) (claimed bool) {
+	var (
+		skipKey        string
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		txnResp        *clientv3.TxnResponse
+		err            error
+	)
+
+	skipKey = common.JOB_SKIP_DIR + runId
+
+	//认领记录随租约过期自动删除
+	if leaseGrantResp, err = jobMgr.lease.Grant(context.TODO(), common.JOB_SKIP_CLAIM_TTL); err != nil {
+		return
+	}
+	if txnResp, err = jobMgr.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(skipKey), "=", 0)).
+		Then(clientv3.OpPut(skipKey, G_register.localIP, clientv3.WithLease(leaseGrantResp.ID))).
+		Commit(); err != nil || !txnResp.Succeeded {
+		jobMgr.lease.Revoke(context.TODO(), leaseGrantResp.ID)
+		return
+	}
+	return true
+}
+
+//记录一次调度的分片已执行完
+func (jobMgr *JobMgr) MarkShardDone(runId string, shardIndex int) (err error) {
+	var (
+		leaseGrantResp *clientv3.LeaseGrantResponse
+	)
+
+	//记录随租约过期自动删除
+	if leaseGrantResp, err = jobMgr.lease.Grant(context.TODO(), common.JOB_SHARD_DONE_TTL); err != nil {
+		return
+	}
+	_, err = jobMgr.kv.Put(context.TODO(), common.JOB_SHARD_DONE_DIR+runId+"/"+strconv.Itoa(shardIndex), G_register.localIP, clientv3.WithLease(leaseGrantResp.ID))
+	return
+}
+
+//一次调度的分片是否已执行完
+func (jobMgr *JobMgr) IsShardDone(runId string, shardIndex int) (done bool, err error) {
+	var (
+		getResp *clientv3.GetResponse
+	)
+
+	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_SHARD_DONE_DIR+runId+"/"+strconv.Itoa(shardIndex), clientv3.WithCountOnly()); err != nil {
+		return
+	}
+	done = getResp.Count != 0
+	return
+}
+
 //初始化管理器
 func InitJobMgr() (err error) {
 	var (
@@ -180,6 +502,12 @@ func InitJobMgr() (err error) {
 		watcher: watcher,
 	}
 
+	//先加载日历, 任务计算下次调度时间时要用到
+	G_jobMgr.watchCalendars()
+
+	//加载集群冻结, 避免启动时冻结尚未生效就开始调度
+	G_jobMgr.watchFreeze()
+
 	//启动任务监听
 	G_jobMgr.watchJobs()
 
@@ -56,7 +56,8 @@ func (logSink *LogSink) writeLoop() {
 				body := "Err\n" +
 					"JobName: " + log.JobName + "\r\n" +
 					"Command: " + log.Command + "\r\n" +
-					"Output: " + log.Output + "\r\n" +
+					"Stdout: " + log.Stdout + "\r\n" +
+					"Stderr: " + log.Stderr + "\r\n" +
 					"PlanTime: " + strPlanTime + "\r\n" +
 					"ScheduleTime: " + strScheduleTime + "\r\n" +
 					"StartTime: " + strStartTime + "\r\n" +
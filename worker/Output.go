@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"strconv"
+
+	"github.com/gyyn/crontab/common"
+)
+
+//有界的输出捕获, 只保留开头和结尾, 避免话多的任务撑爆worker内存和mongodb文档
+type boundedCapture struct {
+	headLimit int
+	tailLimit int
+	head      []byte
+	tail      []byte //写满后作为环形缓冲
+	tailPos   int    //环形缓冲中最旧数据的位置
+	total     int64  //写入的总字节数
+}
+
+//按任务和worker配置确定保留长度
+func buildOutputLimit(job *common.Job) (headLimit int, tailLimit int) {
+	//任务指定了就按任务的, 0表示不保留这一段
+	if job.OutputLimit.HeadBytes != nil {
+		headLimit = *job.OutputLimit.HeadBytes
+	} else if headLimit = G_config.OutputHeadBytes; headLimit <= 0 {
+		headLimit = common.JOB_OUTPUT_HEAD_BYTES
+	}
+	if job.OutputLimit.TailBytes != nil {
+		tailLimit = *job.OutputLimit.TailBytes
+	} else if tailLimit = G_config.OutputTailBytes; tailLimit <= 0 {
+		tailLimit = common.JOB_OUTPUT_TAIL_BYTES
+	}
+	if headLimit < 0 {
+		headLimit = 0
+	}
+	if tailLimit < 0 {
+		tailLimit = 0
+	}
+
+	//超出上限时按比例缩小
+	if headLimit+tailLimit > common.JOB_OUTPUT_MAX_BYTES {
+		headLimit = int(int64(headLimit) * common.JOB_OUTPUT_MAX_BYTES / int64(headLimit+tailLimit))
+		tailLimit = common.JOB_OUTPUT_MAX_BYTES - headLimit
+	}
+	return
+}
+
+func newBoundedCapture(headLimit int, tailLimit int) *boundedCapture {
+	return &boundedCapture{
+		headLimit: headLimit,
+		tailLimit: tailLimit,
+	}
+}
+
+func (c *boundedCapture) Write(p []byte) (n int, err error) {
+	var (
+		size int
+	)
+
+	n = len(p)
+	c.total += int64(n)
+
+	//先填满开头
+	if len(c.head) < c.headLimit {
+		if size = c.headLimit - len(c.head); size > len(p) {
+			size = len(p)
+		}
+		c.head = append(c.head, p[:size]...)
+		p = p[size:]
+	}
+	if len(p) == 0 || c.tailLimit == 0 {
+		return
+	}
+
+	//只有最后tailLimit字节可能留在结尾
+	if len(p) > c.tailLimit {
+		p = p[len(p)-c.tailLimit:]
+	}
+
+	//结尾还没写满时直接追加
+	if len(c.tail) < c.tailLimit {
+		if size = c.tailLimit - len(c.tail); size > len(p) {
+			size = len(p)
+		}
+		c.tail = append(c.tail, p[:size]...)
+		p = p[size:]
+	}
+
+	//写满后覆盖最旧的数据
+	for len(p) > 0 {
+		size = copy(c.tail[c.tailPos:], p)
+		p = p[size:]
+		c.tailPos = (c.tailPos + size) % c.tailLimit
+	}
+	return
+}
+
+//是否有数据被丢弃
+func (c *boundedCapture) Truncated() bool {
+	return c.total > int64(len(c.head)+len(c.tail))
+}
+
+//保留的输出, 截断时在开头和结尾之间标明省略的字节数
+func (c *boundedCapture) Bytes() (output []byte) {
+	output = make([]byte, 0, len(c.head)+len(c.tail)+64)
+	output = append(output, c.head...)
+	if c.Truncated() {
+		output = append(output, []byte("\n...(省略"+strconv.FormatInt(c.total-int64(len(c.head)+len(c.tail)), 10)+"字节)...\n")...)
+	}
+	output = append(output, c.tail[c.tailPos:]...)
+	output = append(output, c.tail[:c.tailPos]...)
+	return
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//放到独立的进程组中, 终止时连同子孙进程一起杀掉
+func setProcessGroup(attr *syscall.SysProcAttr) {
+	attr.Setpgid = true
+}
+
+//给命令所在的整个进程组发信号
+func killProcessGroup(cmd *exec.Cmd, signal syscall.Signal) {
+	syscall.Kill(-cmd.Process.Pid, signal)
+}
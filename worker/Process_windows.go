@@ -0,0 +1,15 @@
+package worker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//windows没有进程组信号, 不做处理
+func setProcessGroup(attr *syscall.SysProcAttr) {
+}
+
+//windows不支持SIGTERM, 直接结束进程
+func killProcessGroup(cmd *exec.Cmd, signal syscall.Signal) {
+	cmd.Process.Kill()
+}
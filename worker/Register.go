@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"time"
 
@@ -16,6 +17,10 @@ type Register struct {
 	lease  clientv3.Lease
 
 	localIP string //本机IP
+
+	stopCtx    context.Context    //worker退出时取消, 停止续租并注销
+	stopCancel context.CancelFunc //取消stopCtx
+	stopped    chan struct{}      //已注销
 }
 
 var (
@@ -60,8 +65,16 @@ func (register *Register) keepOnline() {
 		keepAliveResp  *clientv3.LeaseKeepAliveResponse
 		cancelCtx      context.Context
 		cancelFunc     context.CancelFunc
+		regValue       []byte
 	)
 
+	//注册信息: IP和节点标签
+	if regValue, err = json.Marshal(&common.WorkerInfo{IP: register.localIP, Labels: G_config.Labels}); err != nil {
+		return
+	}
+
+	defer close(register.stopped)
+
 	for {
 		//注册路径
 		regKey = common.JOB_WORKER_DIR + register.localIP
@@ -81,7 +94,7 @@ func (register *Register) keepOnline() {
 		cancelCtx, cancelFunc = context.WithCancel(context.TODO())
 
 		//注册到etcd
-		if _, err = register.kv.Put(cancelCtx, regKey, "", clientv3.WithLease(leaseGrantResp.ID)); err != nil {
+		if _, err = register.kv.Put(cancelCtx, regKey, string(regValue), clientv3.WithLease(leaseGrantResp.ID)); err != nil {
 			goto RETRY
 		}
 
@@ -92,17 +105,43 @@ func (register *Register) keepOnline() {
 				if keepAliveResp == nil { //续租失败
 					goto RETRY
 				}
+			case <-register.stopCtx.Done(): //worker退出, 撤销租约, 注册信息随之删除
+				cancelFunc()
+				register.revoke(leaseGrantResp.ID)
+				return
 			}
 		}
 
 	RETRY:
-		time.Sleep(1 * time.Second)
 		if cancelFunc != nil {
 			cancelFunc()
 		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-register.stopCtx.Done():
+			return
+		}
 	}
 }
 
+//撤销租约, etcd不可用时不会一直等待
+func (register *Register) revoke(leaseId clientv3.LeaseID) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+	)
+
+	ctx, cancelFunc = context.WithTimeout(context.TODO(), time.Duration(G_config.EtcdDialTimeout)*time.Millisecond)
+	defer cancelFunc()
+	register.lease.Revoke(ctx, leaseId)
+}
+
+//注销: 从/cron/workers/下删除本机, master不再把它当作在线节点
+func (register *Register) Deregister() {
+	register.stopCancel()
+	<-register.stopped
+}
+
 func InitRegister() (err error) {
 	var (
 		config  clientv3.Config
@@ -137,7 +176,9 @@ func InitRegister() (err error) {
 		kv:      kv,
 		lease:   lease,
 		localIP: localIp,
+		stopped: make(chan struct{}),
 	}
+	G_register.stopCtx, G_register.stopCancel = context.WithCancel(context.TODO())
 
 	//服务注册
 	go G_register.keepOnline()
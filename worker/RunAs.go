@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/gyyn/crontab/common"
+)
+
+//字符串是否在列表中
+func containsString(list []string, str string) bool {
+	var (
+		item string
+	)
+
+	for _, item = range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+//查找任务的运行用户和运行组, 检查是否允许
+//未指定runAsUser时使用worker配置的defaultRunAsUser, 都为空时返回nil, 以worker自身的用户执行
+func lookupRunAs(job *common.Job) (runAsUser *user.User, gid string, groupIds []string, err error) {
+	var (
+		runAsGroup *user.Group
+		username   string
+	)
+
+	//只允许worker.json中配置的用户, 默认用户由worker自己配置, 不需要在列表中
+	if username = job.RunAsUser; username == "" {
+		username = G_config.DefaultRunAsUser
+	} else if username != G_config.DefaultRunAsUser && !containsString(G_config.RunAsUsers, username) {
+		err = common.ERR_RUN_AS_USER_NOT_ALLOWED
+		return
+	}
+	if username == "" {
+		return
+	}
+
+	if runAsUser, err = user.Lookup(username); err != nil {
+		return
+	}
+	if groupIds, err = runAsUser.GroupIds(); err != nil {
+		return
+	}
+
+	//运行组: 在允许列表中, 或运行用户本身属于该组
+	gid = runAsUser.Gid
+	if job.RunAsGroup != "" {
+		if runAsGroup, err = user.LookupGroup(job.RunAsGroup); err != nil {
+			return
+		}
+		if !containsString(G_config.RunAsGroups, job.RunAsGroup) && !containsString(groupIds, runAsGroup.Gid) {
+			err = common.ERR_RUN_AS_GROUP_NOT_ALLOWED
+			return
+		}
+		gid = runAsGroup.Gid
+	}
+
+	//非root的worker只能以自身用户和主组执行
+	if os.Geteuid() != 0 && (runAsUser.Uid != strconv.Itoa(os.Geteuid()) || gid != strconv.Itoa(os.Getegid())) {
+		err = common.ERR_RUN_AS_NOT_ROOT
+	}
+	return
+}
+
+//本机能否以任务的运行用户执行, 用于抢锁前过滤
+func checkRunAs(job *common.Job) (err error) {
+	_, _, _, err = lookupRunAs(job)
+	return
+}
+
+//构建以任务的运行用户/组执行的进程属性, 没有运行用户或worker不是root时返回nil
+func buildRunAsAttr(job *common.Job) (sysProcAttr *syscall.SysProcAttr, env []string, err error) {
+	var (
+		runAsUser *user.User
+		gid       string
+		groupIds  []string
+		groupId   string
+		id        uint64
+		uid       uint64
+		groups    []uint32
+	)
+
+	if runAsUser, gid, groupIds, err = lookupRunAs(job); err != nil || runAsUser == nil {
+		return
+	}
+
+	env = []string{"HOME=" + runAsUser.HomeDir, "USER=" + runAsUser.Username, "LOGNAME=" + runAsUser.Username}
+
+	//非root的worker已确认就是运行用户, 不需要切换
+	if os.Geteuid() != 0 {
+		return
+	}
+
+	//附加组为运行用户所属的组
+	for _, groupId = range groupIds {
+		if id, err = strconv.ParseUint(groupId, 10, 32); err != nil {
+			return
+		}
+		groups = append(groups, uint32(id))
+	}
+
+	if uid, err = strconv.ParseUint(runAsUser.Uid, 10, 32); err != nil {
+		return
+	}
+	if id, err = strconv.ParseUint(gid, 10, 32); err != nil {
+		return
+	}
+
+	sysProcAttr = credentialAttr(uint32(uid), uint32(id), groups)
+	return
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import "syscall"
+
+//以指定的用户/组执行的进程属性
+func credentialAttr(uid uint32, gid uint32, groups []uint32) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    uid,
+			Gid:    gid,
+			Groups: groups,
+		},
+	}
+}
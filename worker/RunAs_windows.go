@@ -0,0 +1,8 @@
+package worker
+
+import "syscall"
+
+//windows不能切换运行用户, 不会以root运行, 走不到这里
+func credentialAttr(uid uint32, gid uint32, groups []uint32) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
@@ -9,10 +9,15 @@ import (
 
 //任务调度
 type Scheduler struct {
-	jobEventChan      chan *common.JobEvent              //etcd任务事件队列
-	jobPlanTable      map[string]*common.JobSchedulePlan //任务调度计划表
-	jobExecutingTable map[string]*common.JobExecuteInfo  //任务执行表
-	jobResultChan     chan *common.JobExecuteResult      //任务结果队列
+	jobEventChan      chan *common.JobEvent                   //etcd任务事件队列
+	jobPlanTable      map[string]*common.JobSchedulePlan      //任务调度计划表
+	jobExecutingTable map[string][]*common.JobExecuteInfo     //任务执行表, allow策略下同一任务可有多个执行
+	jobResultChan     chan *common.JobExecuteResult           //任务结果队列
+	workflowPlanTable map[string]*common.WorkflowSchedulePlan //工作流调度计划表
+	calendarTable     map[string]*common.Calendar             //日历表, 所有任务的调度计划共用
+	freeze            *common.Freeze                          //当前的集群冻结, 没有冻结时为nil
+	stopChan          chan struct{}                           //worker退出时通知调度协程停止调度
+	stopped           bool                                    //已停止调度, 只继续处理执行结果
 }
 
 var (
@@ -20,60 +25,224 @@ var (
 )
 
 //尝试执行任务
-func (scheduler *Scheduler) TryStartJob(jobPlan *common.JobSchedulePlan, isOnce bool) {
+//onceId为立即执行事件的标识, 定时调度为空
+func (scheduler *Scheduler) TryStartJob(jobPlan *common.JobSchedulePlan, planTime time.Time, onceId string, trigger *common.WorkflowTrigger) {
 	//调度 和 执行 是2件事情
 	var (
+		jobName        string
 		jobExecuteInfo *common.JobExecuteInfo
-		jobExecuting   bool
+		executingInfos []*common.JobExecuteInfo
+		replaces       *common.JobExecuteInfo
+		inWindow       bool
+		frozen         bool
+		reason         string
+		err            error
+		isOnce         bool
+		runId          string
 	)
 
+	//worker正在退出, 不再启动新的执行
+	if scheduler.stopped {
+		return
+	}
+
+	jobName = common.BuildJobFullName(jobPlan.Job.Namespace, jobPlan.Job.Name)
+
+	//同一次调度在各worker上的运行ID相同, 立即执行按事件区分
+	if isOnce = onceId != ""; isOnce {
+		runId = common.BuildOnceRunId(jobPlan.Job, onceId)
+	} else {
+		runId = common.BuildJobRunId(jobPlan.Job, planTime)
+	}
+
+	//暂停的任务保留调度计划, 但不启动
+	if jobPlan.Job.Paused {
+		scheduler.reportNodeSkipped(trigger, jobName, common.ERR_JOB_PAUSED.Error())
+		return
+	}
+
+	//本机不满足任务的节点选择器, 不参与抢锁
+	if !common.MatchWorker(jobPlan.Job, G_register.localIP, G_config.Labels) {
+		return
+	}
+
+	//本机不能以任务的运行用户执行, 不参与抢锁, 留给允许的worker
+	//拒绝原因按运行ID只记录一次, 没有worker允许时也能在日志中看到
+	if err = checkRunAs(jobPlan.Job); err != nil {
+		go scheduler.logSkippedJobOnce(jobPlan.Job, runId, planTime, err.Error())
+		return
+	}
+
+	//有资源限制的任务只由配置了cgroup的worker抢锁
+	if err = checkCgroup(jobPlan.Job); err != nil {
+		return
+	}
+
 	if !isOnce {
-		job := jobPlan.Job
-		startTime := common.Str2Time(job.StartTime)
-		stopTime := common.Str2Time(job.StopTime)
-		if !startTime.IsZero() && !startTime.IsZero() && startTime.After(stopTime) {
-			return
-		}
-		now := time.Now()
-		//已到停止时间（停止时间在当前时间之前）
-		if !stopTime.IsZero() && stopTime.Before(now) {
+		//不在开始/停止时间之内
+		if inWindow, _ = common.CheckJobWindow(jobPlan, time.Now()); !inWindow {
 			return
 		}
-		//未到开始时间（开始时间在当前时间之后）
-		if !startTime.IsZero() && startTime.After(now) {
+	}
+
+	//集群冻结期间不启动定时调度和工作流触发的执行, 手动立即执行不受影响
+	if !isOnce || trigger != nil {
+		if frozen, reason = common.CheckFreeze(scheduler.freeze, jobPlan.Job, G_config.Labels, time.Now()); frozen {
+			//只冻结了部分worker时, 留给没冻结的worker执行, 都不执行时由工作流超时兜底
+			if common.IsClusterWideFreeze(scheduler.freeze) {
+				scheduler.reportNodeSkipped(trigger, jobName, reason)
+				go scheduler.logSkippedJobOnce(jobPlan.Job, runId, planTime, reason)
+			}
 			return
 		}
 	}
 
 	//执行的任务可能运行很久, 1分钟会调度60次，但是只能执行1次, 防止并发！
-
-	//如果任务正在执行，跳过本次调度
-	if jobExecuteInfo, jobExecuting = scheduler.jobExecutingTable[jobPlan.Job.Name]; jobExecuting {
-		//fmt.Println("尚未退出,跳过执行:", jobPlan.Job.Name)
-		return
+	if executingInfos = scheduler.jobExecutingTable[jobName]; len(executingInfos) != 0 {
+		switch jobPlan.Job.ConcurrencyPolicy {
+		case common.CONCURRENCY_POLICY_ALLOW: //允许重叠执行
+		case common.CONCURRENCY_POLICY_REPLACE: //取消旧的执行, 新执行等它释放锁后再开始
+			replaces = executingInfos[len(executingInfos)-1]
+			replaces.CancelFunc()
+		default: //任务正在执行，跳过本次调度
+			scheduler.logSkippedJob(jobPlan.Job, planTime, common.ERR_JOB_SKIPPED.Error())
+			scheduler.reportNodeSkipped(trigger, jobName, common.ERR_JOB_SKIPPED.Error())
+			return
+		}
 	}
 
 	//构建执行状态信息
-	jobExecuteInfo = common.BuildJobExecuteInfo(jobPlan)
+	jobExecuteInfo = common.BuildJobExecuteInfo(jobPlan, planTime)
+	jobExecuteInfo.IsOnce = isOnce
+	jobExecuteInfo.RunId = runId
+	if isOnce {
+		jobExecuteInfo.Schedule = ""
+	}
+	jobExecuteInfo.Trigger = trigger
+	jobExecuteInfo.Replaces = replaces
 
 	//保存执行状态
-	scheduler.jobExecutingTable[jobPlan.Job.Name] = jobExecuteInfo
+	scheduler.jobExecutingTable[jobName] = append(executingInfos, jobExecuteInfo)
 
 	//执行任务
-	fmt.Println("执行任务:", jobExecuteInfo.Job.Name, jobExecuteInfo.PlanTime, jobExecuteInfo.RealTime)
+	fmt.Println("执行任务:", jobName, jobExecuteInfo.PlanTime, jobExecuteInfo.RealTime)
 	G_executor.ExecuteJob(jobExecuteInfo)
 }
 
+//工作流触发的执行没能启动, 上报节点失败, 避免工作流一直处于运行中
+func (scheduler *Scheduler) reportNodeSkipped(trigger *common.WorkflowTrigger, jobName string, reason string) {
+	if trigger == nil {
+		return
+	}
+	go G_workflowMgr.ReportNodeResult(trigger, jobName, G_register.localIP, false, reason)
+}
+
+//跳过的调度也记录一条日志
+func (scheduler *Scheduler) logSkippedJob(job *common.Job, planTime time.Time, reason string) {
+	var (
+		now    time.Time
+		jobLog *common.JobLog
+	)
+
+	now = time.Now()
+	localIp, _ := GetLocalIP()
+	jobLog = &common.JobLog{
+		Namespace:    job.Namespace,
+		JobName:      job.Name,
+		Command:      job.Command,
+		Err:          reason,
+		PlanTime:     planTime.UnixNano() / 1000 / 1000,
+		ScheduleTime: now.UnixNano() / 1000 / 1000,
+		StartTime:    now.UnixNano() / 1000 / 1000,
+		EndTime:      now.UnixNano() / 1000 / 1000,
+		LocalIP:      localIp,
+		Email:        job.Email,
+		IsSkipped:    true,
+		Status:       common.JOB_STATUS_SKIPPED,
+	}
+	G_logSink.Append(jobLog)
+
+	fmt.Println("跳过任务:", job.Name, reason)
+}
+
+//每个worker都会跳过同一次调度, 只由认领到的worker记录日志
+func (scheduler *Scheduler) logSkippedJobOnce(job *common.Job, runId string, planTime time.Time, reason string) {
+	if G_jobMgr.ClaimSkipLog(runId) {
+		scheduler.logSkippedJob(job, planTime, reason)
+	}
+}
+
+//加入补跑队列, 队列长度受补跑策略限制
+func (scheduler *Scheduler) addMisfireTimes(jobPlan *common.JobSchedulePlan, misfireTimes []time.Time) {
+	var (
+		limit int
+	)
+
+	if len(misfireTimes) == 0 {
+		return
+	}
+
+	jobPlan.MisfireTimes = append(jobPlan.MisfireTimes, misfireTimes...)
+
+	limit = common.BuildMisfireLimit(jobPlan.Job)
+	if len(jobPlan.MisfireTimes) > limit {
+		jobPlan.MisfireTimes = jobPlan.MisfireTimes[len(jobPlan.MisfireTimes)-limit:]
+	}
+}
+
+//启动补跑: allow策略一次全部启动, 其他策略等上一次执行结束后逐个启动
+func (scheduler *Scheduler) tryStartMisfire(jobPlan *common.JobSchedulePlan) {
+	var (
+		jobName string
+	)
+
+	jobName = common.BuildJobFullName(jobPlan.Job.Namespace, jobPlan.Job.Name)
+	for len(jobPlan.MisfireTimes) != 0 {
+		if jobPlan.Job.ConcurrencyPolicy != common.CONCURRENCY_POLICY_ALLOW && len(scheduler.jobExecutingTable[jobName]) != 0 {
+			return
+		}
+		fmt.Println("补跑任务:", jobName, jobPlan.MisfireTimes[0])
+		scheduler.TryStartJob(jobPlan, jobPlan.MisfireTimes[0], "", nil)
+		jobPlan.MisfireTimes = jobPlan.MisfireTimes[1:]
+	}
+}
+
+//从执行表中删除一次执行
+func (scheduler *Scheduler) removeExecuteInfo(jobExecuteInfo *common.JobExecuteInfo) {
+	var (
+		jobName        string
+		executingInfos []*common.JobExecuteInfo
+		i              int
+	)
+
+	jobName = common.BuildJobFullName(jobExecuteInfo.Job.Namespace, jobExecuteInfo.Job.Name)
+
+	executingInfos = scheduler.jobExecutingTable[jobName]
+	for i = range executingInfos {
+		if executingInfos[i] == jobExecuteInfo {
+			executingInfos = append(executingInfos[:i], executingInfos[i+1:]...)
+			break
+		}
+	}
+
+	if len(executingInfos) == 0 {
+		delete(scheduler.jobExecutingTable, jobName)
+	} else {
+		scheduler.jobExecutingTable[jobName] = executingInfos
+	}
+}
+
 //重新计算任务调度状态
 func (scheduler *Scheduler) TrySchedule() (scheduleAfter time.Duration) {
 	var (
-		jobPlan  *common.JobSchedulePlan
-		now      time.Time
-		nearTime *time.Time
+		jobPlan      *common.JobSchedulePlan
+		workflowPlan *common.WorkflowSchedulePlan
+		now          time.Time
+		nearTime     *time.Time
 	)
 
 	//如果任务表为空话，随便睡眠多久
-	if len(scheduler.jobPlanTable) == 0 {
+	if len(scheduler.jobPlanTable) == 0 && len(scheduler.workflowPlanTable) == 0 {
 		scheduleAfter = 1 * time.Second
 		return
 	}
@@ -83,16 +252,43 @@ func (scheduler *Scheduler) TrySchedule() (scheduleAfter time.Duration) {
 
 	//遍历所有任务
 	for _, jobPlan = range scheduler.jobPlanTable {
-		if jobPlan.NextTime.Before(now) || jobPlan.NextTime.Equal(now) {
-			scheduler.TryStartJob(jobPlan, false)
-			jobPlan.NextTime = jobPlan.Expr.Next(now) //更新下次执行时间
+		//零值表示没有下次调度(表达式不会再触发, 或日历排除了所有日期)
+		if !jobPlan.NextTime.IsZero() && (jobPlan.NextTime.Before(now) || jobPlan.NextTime.Equal(now)) {
+			//调度延迟期间错过的计划时间, 按补跑策略加入补跑队列
+			scheduler.addMisfireTimes(jobPlan, common.BuildMisfireTimes(jobPlan, jobPlan.NextTime, now))
+			scheduler.TryStartJob(jobPlan, jobPlan.NextTime, "", nil)
+			jobPlan.NextTime = common.BuildNextTime(jobPlan, now) //更新下次执行时间, 跳过日历排除的日期
 		}
 
+		//补跑错过的调度, 使用原本的计划时间
+		scheduler.tryStartMisfire(jobPlan)
+
 		//统计最近一个要过期的任务时间
+		if jobPlan.NextTime.IsZero() {
+			continue
+		}
 		if nearTime == nil || jobPlan.NextTime.Before(*nearTime) {
 			nearTime = &jobPlan.NextTime
 		}
 	}
+
+	//遍历所有工作流, 到期时创建一次工作流运行
+	for _, workflowPlan = range scheduler.workflowPlanTable {
+		if workflowPlan.NextTime.Before(now) || workflowPlan.NextTime.Equal(now) {
+			go G_workflowMgr.StartWorkflowRun(workflowPlan.Workflow, workflowPlan.NextTime)
+			workflowPlan.NextTime = workflowPlan.Expr.Next(now)
+		}
+
+		if nearTime == nil || workflowPlan.NextTime.Before(*nearTime) {
+			nearTime = &workflowPlan.NextTime
+		}
+	}
+	//没有任何待调度的时间
+	if nearTime == nil {
+		scheduleAfter = 1 * time.Second
+		return
+	}
+
 	//下次调度间隔（最近要执行的任务调度时间 - 当前时间）
 	scheduleAfter = (*nearTime).Sub(now)
 	return
@@ -101,65 +297,176 @@ func (scheduler *Scheduler) TrySchedule() (scheduleAfter time.Duration) {
 //处理任务事件
 func (scheduler *Scheduler) handleJobEvent(jobEvent *common.JobEvent) {
 	var (
-		jobSchedulePlan *common.JobSchedulePlan
-		jobExecuteInfo  *common.JobExecuteInfo
-		jobExecuting    bool
-		jobExisted      bool
-		err             error
+		jobSchedulePlan      *common.JobSchedulePlan
+		workflowSchedulePlan *common.WorkflowSchedulePlan
+		jobExecuteInfo       *common.JobExecuteInfo
+		jobExisted           bool
+		jobName              string
+		err                  error
 	)
+
+	//任务表以命名空间/任务名为key
+	if jobEvent.Job != nil {
+		jobName = common.BuildJobFullName(jobEvent.Job.Namespace, jobEvent.Job.Name)
+	}
 	switch jobEvent.EventType {
 	case common.JOB_EVENT_SAVE: //保存任务事件
 		if jobSchedulePlan, err = common.BuildJobSchedulePlan(jobEvent.Job); err != nil {
 			return
 		}
-		scheduler.jobPlanTable[jobEvent.Job.Name] = jobSchedulePlan
+		jobSchedulePlan.Calendars = scheduler.calendarTable
+		jobSchedulePlan.NextTime = common.BuildNextTime(jobSchedulePlan, time.Now())
+		//启动前停机期间错过的调度
+		if !jobEvent.LastPlanTime.IsZero() {
+			jobSchedulePlan.MisfireTimes = common.BuildMisfireTimes(jobSchedulePlan, jobEvent.LastPlanTime, time.Now())
+		}
+		scheduler.jobPlanTable[jobName] = jobSchedulePlan
 	case common.JOB_EVENT_DELETE: //删除任务事件
-		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobEvent.Job.Name]; jobExisted {
-			delete(scheduler.jobPlanTable, jobEvent.Job.Name)
+		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobName]; jobExisted {
+			delete(scheduler.jobPlanTable, jobName)
 		}
 	case common.JOB_EVENT_KILL: //强杀任务事件
 		//取消掉Command执行, 判断任务是否在执行中
-		if jobExecuteInfo, jobExecuting = scheduler.jobExecutingTable[jobEvent.Job.Name]; jobExecuting {
+		for _, jobExecuteInfo = range scheduler.jobExecutingTable[jobName] {
 			jobExecuteInfo.CancelFunc() //触发command杀死shell子进程, 任务得到退出
 		}
 	case common.JOB_EVENT_ONCE: //立即执行任务事件
-		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobEvent.Job.Name]; jobExisted {
-			scheduler.TryStartJob(jobSchedulePlan, true)
+		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobName]; jobExisted {
+			//立即执行以当前时间为计划时间
+			scheduler.TryStartJob(jobSchedulePlan, time.Now(), jobEvent.OnceId, jobEvent.Trigger)
+		} else {
+			//任务不存在, 工作流节点直接失败
+			scheduler.reportNodeSkipped(jobEvent.Trigger, jobName, common.ERR_JOB_NOT_FOUND.Error())
+		}
+	case common.JOB_EVENT_WORKFLOW_SAVE: //保存工作流事件
+		//没有cron表达式的工作流只能手动触发
+		if jobEvent.Workflow.CronExpr == "" {
+			delete(scheduler.workflowPlanTable, jobEvent.Workflow.Name)
+			return
+		}
+		if workflowSchedulePlan, err = common.BuildWorkflowSchedulePlan(jobEvent.Workflow); err != nil {
+			return
 		}
+		scheduler.workflowPlanTable[jobEvent.Workflow.Name] = workflowSchedulePlan
+	case common.JOB_EVENT_WORKFLOW_DELETE: //删除工作流事件
+		delete(scheduler.workflowPlanTable, jobEvent.Workflow.Name)
+	case common.JOB_EVENT_CALENDAR_SAVE: //保存日历事件
+		scheduler.calendarTable[jobEvent.Calendar.Name] = jobEvent.Calendar
+		scheduler.refreshNextTimes()
+	case common.JOB_EVENT_CALENDAR_DELETE: //删除日历事件
+		delete(scheduler.calendarTable, jobEvent.Calendar.Name)
+		scheduler.refreshNextTimes()
+	case common.JOB_EVENT_FREEZE_SAVE: //设置集群冻结事件
+		scheduler.freeze = jobEvent.Freeze
+	case common.JOB_EVENT_FREEZE_CLEAR: //解除集群冻结事件
+		scheduler.freeze = nil
+	}
+}
+
+//日历变化后重新计算所有任务的下次调度时间
+//已经到期还没调度的不重新计算, 留给TrySchedule执行, 否则这次调度会丢掉
+func (scheduler *Scheduler) refreshNextTimes() {
+	var (
+		jobPlan *common.JobSchedulePlan
+		now     time.Time
+	)
+
+	now = time.Now()
+	for _, jobPlan = range scheduler.jobPlanTable {
+		if !jobPlan.NextTime.IsZero() && !jobPlan.NextTime.After(now) {
+			continue
+		}
+		jobPlan.NextTime = common.BuildNextTime(jobPlan, now)
 	}
 }
 
 //处理任务结果
 func (scheduler *Scheduler) handleJobResult(result *common.JobExecuteResult) {
 	var (
-		jobLog *common.JobLog
+		jobLog     *common.JobLog
+		jobName    string
+		jobPlan    *common.JobSchedulePlan
+		jobExisted bool
+		reason     string
 	)
-	//删除执行状态
-	delete(scheduler.jobExecutingTable, result.ExecuteInfo.Job.Name)
+
+	jobName = common.BuildJobFullName(result.ExecuteInfo.Job.Namespace, result.ExecuteInfo.Job.Name)
+	if result.Err != nil {
+		reason = result.Err.Error()
+	}
+	//还会重试的任务保留执行状态, 最后一次尝试结束后再删除
+	if !result.WillRetry {
+		//删除执行状态
+		scheduler.removeExecuteInfo(result.ExecuteInfo)
+
+		//释放context
+		result.ExecuteInfo.CancelFunc()
+	}
+
+	//worker退出前没来得及抢锁, 由其他worker执行, 不记录
+	if result.Err == common.ERR_WORKER_STOPPING {
+		return
+	}
 
 	//生成执行日志
-	if result.Err != common.ERR_LOCK_ALREADY_REQUIRED {
+	//抢锁失败默认不记录, 否则每次调度每个没抢到锁的worker都会产生一条日志
+	if result.Err != common.ERR_LOCK_ALREADY_REQUIRED || G_config.LogLockConflict {
 		localIp, _ := GetLocalIP()
 		jobLog = &common.JobLog{
+			Namespace:    result.ExecuteInfo.Job.Namespace,
 			JobName:      result.ExecuteInfo.Job.Name,
 			Command:      result.ExecuteInfo.Job.Command,
-			Output:       string(result.Output),
+			Stdout:       string(result.Stdout),
+			Stderr:       string(result.Stderr),
+			StdoutBytes:  result.StdoutBytes,
+			StderrBytes:  result.StderrBytes,
+			Truncated:    result.Truncated,
+			ExitCode:     result.ExitCode,
+			Status:       common.BuildJobStatus(result),
 			PlanTime:     result.ExecuteInfo.PlanTime.UnixNano() / 1000 / 1000,
 			ScheduleTime: result.ExecuteInfo.RealTime.UnixNano() / 1000 / 1000,
 			StartTime:    result.StartTime.UnixNano() / 1000 / 1000,
 			EndTime:      result.EndTime.UnixNano() / 1000 / 1000,
 			LocalIP:      localIp,
 			Email:        result.ExecuteInfo.Job.Email,
+			IsTimeout:    result.IsTimeout,
+			IsOOM:        result.IsOOM,
+			Signal:       result.Signal,
+			IsSkipped:    result.Err == common.ERR_LOCK_ALREADY_REQUIRED,
+			Attempt:      result.Attempt,
+			RunId:        result.ExecuteInfo.RunId,
+			ShardIndex:   result.ExecuteInfo.ShardIndex,
+			Schedule:     result.ExecuteInfo.Schedule,
 		}
-		if result.Err != nil {
-			jobLog.Err = result.Err.Error()
-		} else {
-			jobLog.Err = ""
+		if result.ExecuteInfo.Job.ExecuteMode == common.EXECUTE_MODE_SHARD {
+			jobLog.ShardTotal = result.ExecuteInfo.Job.ShardTotal
 		}
+		jobLog.Err = reason
 		G_logSink.Append(jobLog)
 	}
 
-	fmt.Println("任务执行完成:", result.ExecuteInfo.Job.Name, string(result.Output), result.Err)
+	if result.Err != common.ERR_LOCK_ALREADY_REQUIRED {
+		//记录最近一次执行过的计划时间, 不论成败, 供重启后计算错过的调度
+		if !result.ExecuteInfo.IsOnce {
+			go G_jobMgr.SaveLastPlanTime(jobName, result.ExecuteInfo.PlanTime)
+		}
+
+		if result.Err == nil && !result.ExecuteInfo.IsOnce {
+			//只有at调度的任务, 全部执行过后不再调度
+			if common.IsOneShotJob(result.ExecuteInfo.Job) {
+				if jobPlan, jobExisted = scheduler.jobPlanTable[jobName]; jobExisted && jobPlan.NextTime.IsZero() && len(jobPlan.MisfireTimes) == 0 {
+					go G_jobMgr.CompleteJob(jobName)
+				}
+			}
+		}
+
+		//工作流节点的最终结果, 上报并触发下游
+		if result.ExecuteInfo.Trigger != nil && !result.WillRetry {
+			go G_workflowMgr.ReportNodeResult(result.ExecuteInfo.Trigger, jobName, G_register.localIP, result.Err == nil, reason)
+		}
+	}
+
+	fmt.Println("任务执行完成:", jobName, result.Attempt, string(result.Stdout), string(result.Stderr), result.Err)
 }
 
 //调度协程
@@ -187,6 +494,13 @@ func (scheduler *Scheduler) scheduleLoop() {
 			scheduler.handleJobResult(jobResult)
 			//定时器到期，阻塞解除
 		case <-scheduleTimer.C: //最近的任务到期了
+		case <-scheduler.stopChan: //worker正在退出
+			scheduler.stopped = true
+			scheduleTimer.Stop()
+		}
+		//停止后不再调度, 只处理事件和正在执行的任务的结果
+		if scheduler.stopped {
+			continue
 		}
 		//调度一次任务
 		scheduleAfter = scheduler.TrySchedule()
@@ -200,14 +514,22 @@ func InitScheduler() (err error) {
 	G_scheduler = &Scheduler{
 		jobEventChan:      make(chan *common.JobEvent, 1000),
 		jobPlanTable:      make(map[string]*common.JobSchedulePlan),
-		jobExecutingTable: make(map[string]*common.JobExecuteInfo),
+		jobExecutingTable: make(map[string][]*common.JobExecuteInfo),
 		jobResultChan:     make(chan *common.JobExecuteResult, 1000),
+		workflowPlanTable: make(map[string]*common.WorkflowSchedulePlan),
+		calendarTable:     make(map[string]*common.Calendar),
+		stopChan:          make(chan struct{}),
 	}
 	//启动调度协程
 	go G_scheduler.scheduleLoop()
 	return
 }
 
+//停止调度, 返回后不会再启动新的执行
+func (scheduler *Scheduler) Stop() {
+	scheduler.stopChan <- struct{}{}
+}
+
 //推送任务变化事件
 func (scheduler *Scheduler) PushJobEvent(jobEvent *common.JobEvent) {
 	scheduler.jobEventChan <- jobEvent
@@ -0,0 +1,35 @@
+package worker
+
+import (
+	"strconv"
+	"syscall"
+)
+
+//常见信号的名字, 用于记录日志
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+//信号名, 不认识的信号返回SIG加编号
+func signalName(signal syscall.Signal) string {
+	var (
+		name string
+		ok   bool
+	)
+
+	if name, ok = signalNames[signal]; ok {
+		return name
+	}
+	return "SIG" + strconv.Itoa(int(signal))
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import "syscall"
+
+//只有unix上才有的信号
+func init() {
+	signalNames[syscall.SIGXCPU] = "SIGXCPU"
+	signalNames[syscall.SIGXFSZ] = "SIGXFSZ"
+}
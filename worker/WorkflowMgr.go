@@ -0,0 +1,263 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/gyyn/crontab/common"
+)
+
+//工作流管理器
+type WorkflowMgr struct {
+	client  *clientv3.Client
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+}
+
+var (
+	//单例
+	G_workflowMgr *WorkflowMgr
+)
+
+//监听工作流变化
+func (workflowMgr *WorkflowMgr) watchWorkflows() (err error) {
+	var (
+		getResp            *clientv3.GetResponse
+		kvpair             *mvccpb.KeyValue
+		workflow           *common.Workflow
+		watchStartRevision int64
+		watchChan          clientv3.WatchChan
+		watchResp          clientv3.WatchResponse
+		watchEvent         *clientv3.Event
+		jobEvent           *common.JobEvent
+	)
+
+	//get一下/cron/workflows/目录下的所有工作流
+	if getResp, err = workflowMgr.kv.Get(context.TODO(), common.JOB_WORKFLOW_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+
+	for _, kvpair = range getResp.Kvs {
+		if workflow, err = common.UnpackWorkflow(kvpair.Value); err == nil {
+			G_scheduler.PushJobEvent(common.BuildWorkflowEvent(common.JOB_EVENT_WORKFLOW_SAVE, workflow))
+		}
+	}
+
+	//从该revision向后监听变化事件
+	go func() {
+		watchStartRevision = getResp.Header.Revision + 1
+		watchChan = workflowMgr.watcher.Watch(context.TODO(), common.JOB_WORKFLOW_DIR, clientv3.WithRev(watchStartRevision), clientv3.WithPrefix())
+		for watchResp = range watchChan {
+			for _, watchEvent = range watchResp.Events {
+				switch watchEvent.Type {
+				case mvccpb.PUT: //工作流保存事件
+					if workflow, err = common.UnpackWorkflow(watchEvent.Kv.Value); err != nil {
+						continue
+					}
+					jobEvent = common.BuildWorkflowEvent(common.JOB_EVENT_WORKFLOW_SAVE, workflow)
+				case mvccpb.DELETE: //工作流被删除了
+					workflow = &common.Workflow{Name: common.ExtractWorkflowName(string(watchEvent.Kv.Key))}
+					jobEvent = common.BuildWorkflowEvent(common.JOB_EVENT_WORKFLOW_DELETE, workflow)
+				}
+				G_scheduler.PushJobEvent(jobEvent)
+			}
+		}
+	}()
+	return
+}
+
+//cron到期时启动一次工作流运行
+//运行ID由计划时间生成, 多个worker同时到期也只有一个能创建成功
+func (workflowMgr *WorkflowMgr) StartWorkflowRun(workflow *common.Workflow, planTime time.Time) (err error) {
+	var (
+		workflowRun    *common.WorkflowRun
+		runKey         string
+		runValue       []byte
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		txnResp        *clientv3.TxnResponse
+		node           string
+	)
+
+	workflowRun = common.BuildWorkflowRun(workflow, workflow.Name+"-"+strconv.FormatInt(planTime.Unix(), 10), planTime)
+	runKey = common.BuildWorkflowRunKey(workflow.Name, workflowRun.RunId)
+	if runValue, err = json.Marshal(workflowRun); err != nil {
+		return
+	}
+
+	//运行记录带租约, 到期自动清理
+	if leaseGrantResp, err = workflowMgr.lease.Grant(context.TODO(), common.JOB_WORKFLOW_RUN_TTL); err != nil {
+		return
+	}
+
+	//事务创建运行记录
+	if txnResp, err = workflowMgr.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(runKey), "=", 0)).
+		Then(clientv3.OpPut(runKey, string(runValue), clientv3.WithLease(leaseGrantResp.ID))).
+		Commit(); err != nil {
+		return
+	}
+
+	//其他worker已经创建了, 释放租约
+	if !txnResp.Succeeded {
+		workflowMgr.lease.Revoke(context.TODO(), leaseGrantResp.ID)
+		err = common.ERR_WORKFLOW_RUN_EXISTED
+		return
+	}
+
+	//通过/cron/once触发根节点
+	for _, node = range common.BuildWorkflowRoots(workflow) {
+		if err = common.OnceWorkflowNode(workflowMgr.kv, workflowMgr.lease, workflowRun, node); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//乐观锁更新一次工作流运行记录, 冲突时重新读取
+//update返回false表示不需要更新
+func (workflowMgr *WorkflowMgr) updateWorkflowRun(runKey string, update func(workflowRun *common.WorkflowRun) bool) (workflowRun *common.WorkflowRun, updated bool, err error) {
+	var (
+		getResp  *clientv3.GetResponse
+		runValue []byte
+		txnResp  *clientv3.TxnResponse
+	)
+
+	for {
+		if getResp, err = workflowMgr.kv.Get(context.TODO(), runKey); err != nil {
+			return
+		}
+		if len(getResp.Kvs) == 0 {
+			err = common.ERR_WORKFLOW_RUN_NOT_FOUND
+			return
+		}
+
+		workflowRun = &common.WorkflowRun{}
+		if err = json.Unmarshal(getResp.Kvs[0].Value, workflowRun); err != nil {
+			return
+		}
+
+		if !update(workflowRun) {
+			return
+		}
+		if runValue, err = json.Marshal(workflowRun); err != nil {
+			return
+		}
+
+		if txnResp, err = workflowMgr.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(runKey), "=", getResp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(runKey, string(runValue), clientv3.WithIgnoreLease())).
+			Commit(); err != nil {
+			return
+		}
+		if txnResp.Succeeded {
+			updated = true
+			return
+		}
+	}
+}
+
+//记录工作流节点开始执行, 由抢到锁的worker调用
+func (workflowMgr *WorkflowMgr) ReportNodeStart(trigger *common.WorkflowTrigger, jobName string, worker string) (err error) {
+	_, _, err = workflowMgr.updateWorkflowRun(common.BuildWorkflowRunKey(trigger.WorkflowName, trigger.RunId), func(workflowRun *common.WorkflowRun) bool {
+		return common.StartWorkflowNode(workflowRun, jobName, worker)
+	})
+	return
+}
+
+//上报工作流节点的执行结果, jobName为命名空间/任务名, reason为失败原因
+//上游全部成功的下游节点通过/cron/once触发
+func (workflowMgr *WorkflowMgr) ReportNodeResult(trigger *common.WorkflowTrigger, jobName string, worker string, success bool, reason string) (err error) {
+	var (
+		workflowRun *common.WorkflowRun
+		readyNodes  []string
+		node        string
+	)
+
+	if workflowRun, _, err = workflowMgr.updateWorkflowRun(common.BuildWorkflowRunKey(trigger.WorkflowName, trigger.RunId), func(workflowRun *common.WorkflowRun) bool {
+		if workflowRun.NodeStatus[jobName] != common.WORKFLOW_STATUS_RUNNING {
+			return false
+		}
+		readyNodes = common.UpdateWorkflowRun(workflowRun, jobName, worker, success, reason)
+		return true
+	}); err != nil {
+		return
+	}
+
+	//触发下游节点
+	for _, node = range readyNodes {
+		if err = common.OnceWorkflowNode(workflowMgr.kv, workflowMgr.lease, workflowRun, node); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//定期检查运行中的工作流, 超时的置为失败, 避免节点没有结果时一直处于运行中
+//多个worker同时检查时由乐观锁保证只更新一次
+func (workflowMgr *WorkflowMgr) checkDeadlines() {
+	var (
+		getResp     *clientv3.GetResponse
+		kvPair      *mvccpb.KeyValue
+		workflowRun *common.WorkflowRun
+		err         error
+	)
+
+	for {
+		time.Sleep(common.JOB_WORKFLOW_CHECK_INTERVAL * time.Second)
+
+		if getResp, err = workflowMgr.kv.Get(context.TODO(), common.JOB_WORKFLOW_RUN_DIR, clientv3.WithPrefix()); err != nil {
+			continue
+		}
+		for _, kvPair = range getResp.Kvs {
+			workflowRun = &common.WorkflowRun{}
+			if err = json.Unmarshal(kvPair.Value, workflowRun); err != nil {
+				continue
+			}
+			if workflowRun.Status != common.WORKFLOW_STATUS_RUNNING {
+				continue
+			}
+			workflowMgr.updateWorkflowRun(string(kvPair.Key), func(workflowRun *common.WorkflowRun) bool {
+				return common.ExpireWorkflowRun(workflowRun, time.Now())
+			})
+		}
+	}
+}
+
+//初始化工作流管理器
+func InitWorkflowMgr() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	//初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     //集群地址
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, //连接超时
+	}
+
+	//建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	//赋值单例
+	G_workflowMgr = &WorkflowMgr{
+		client:  client,
+		kv:      clientv3.NewKV(client),
+		lease:   clientv3.NewLease(client),
+		watcher: clientv3.NewWatcher(client),
+	}
+
+	//检查超时的工作流运行
+	go G_workflowMgr.checkDeadlines()
+
+	//启动工作流监听
+	err = G_workflowMgr.watchWorkflows()
+	return
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/gyyn/crontab/worker"
@@ -28,7 +31,8 @@ func initEnv() {
 
 func main() {
 	var (
-		err error
+		err        error
+		signalChan chan os.Signal
 	)
 
 	//初始化命令行参数
@@ -52,6 +56,11 @@ func main() {
 		goto ERR
 	}
 
+	//准备cgroup父目录
+	if err = worker.InitCgroup(); err != nil {
+		goto ERR
+	}
+
 	//启动执行器
 	if err = worker.InitExecutor(); err != nil {
 		goto ERR
@@ -67,11 +76,21 @@ func main() {
 		goto ERR
 	}
 
-	//正常退出
-	for {
-		time.Sleep(1 * time.Second)
+	//初始化工作流管理器
+	if err = worker.InitWorkflowMgr(); err != nil {
+		goto ERR
 	}
 
+	//等待退出信号, 先停止调度并注销, 再终止正在执行的任务后退出
+	signalChan = make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+	<-signalChan
+	worker.G_scheduler.Stop()
+	worker.G_register.Deregister()
+	worker.G_executor.Shutdown()
+
+	//等待最后一批日志自动提交
+	time.Sleep(time.Duration(worker.G_config.JobLogCommitTimeout)*time.Millisecond + time.Second)
 	return
 
 ERR: